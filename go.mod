@@ -0,0 +1,3 @@
+module github.com/ashwinb039/Map-Reduce
+
+go 1.24
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ashwinb039/Map-Reduce/mapreduce"
+)
+
+// isFlagSet reports whether the flag name was given on the command line
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma-separated flag value, returning nil if empty
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// stdinPiped reports whether standard input is a pipe or file rather than
+// a terminal
+func stdinPiped() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+// command is a parsed command line. Exactly one of mr, merge and generate
+// is set.
+type command struct {
+	// mr is the job to run
+	mr *mapreduce.MapReduce
+	// merge is the file to sum the reduce outputs in mergeInputs into
+	merge       string
+	mergeInputs []string
+	// generate is the number of synthetic EHR records to write
+	generate int
+}
+
+// parseCommand defines the command's flags on fs and parses args with them,
+// building the job they describe
+func parseCommand(fs *flag.FlagSet, args []string) (*command, error) {
+	input := fs.String("input", ".", `input directory or glob pattern, or "-" for standard input`)
+	output := fs.String("output", "", "directory for reduce output and the run manifest (default the current directory)")
+	nReduce := fs.Int("nreduce", 1, "number of reduce partitions and output files")
+	recursive := fs.Bool("recursive", false, "include input files in subdirectories")
+	addr := fs.String("addr", mapreduce.DefaultAddr, "master RPC listen address")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics over HTTP on this address")
+	timestamp := fs.Bool("timestamp", false, "add the start time to output file names to keep earlier runs")
+	incremental := fs.Bool("incremental", false, "process only input files added since the last run")
+	force := fs.Bool("force", false, "rerun even if the inputs are unchanged since the last run")
+	dryRun := fs.Bool("dry-run", false, "print the job plan without running it")
+	merge := fs.String("merge", "", "sum the reduce output files given as arguments into this file and exit")
+	generate := fs.Int("generate", 0, "write this many synthetic EHR records to standard output and exit")
+	splitSize := fs.Int64("split-size", 0, "split input files into chunks of about this many bytes")
+	timeout := fs.Duration("timeout", 0, "abort the job if it runs longer than this")
+	ordered := fs.Bool("ordered", false, "run map tasks one at a time in input order")
+	workers := fs.Int("workers", 0, "number of map workers; 0 means automatic: 2, or with -split-size one per split up to the CPU count")
+	byAge := fs.Bool("by-age", false, "also count diagnoses per age bracket")
+	ageBoundaries := fs.String("age-boundaries", "", "comma-separated ages at which -by-age brackets start (default 18,40,65)")
+	groupBy := fs.String("group-by", "", "comma-separated EHR, schema or optional fields to count (default Diagnosis,Treatment)")
+	conflicts := fs.Bool("id-conflicts", false, "report PatientIDs seen with differing names, ages or diagnoses")
+	collisions := fs.Bool("name-collisions", false, "report names shared by more than one PatientID")
+	crossTab := fs.Bool("crosstab", false, "also count treatments per diagnosis")
+	stdout := fs.Bool("stdout", false, "write reduce output to standard output instead of files")
+	ageStats := fs.Bool("age-stats", false, "also report the mean and median age per diagnosis")
+	bySource := fs.Bool("by-source", false, "also count records per input file")
+	fieldSep := fs.String("field-sep", "", `field separator for input records and output lines, such as "|" or "\t"`)
+	inputFormat := fs.String("input-format", "text", "input record format: text, csv, tsv or json")
+	schema := fs.String("schema", "", "comma-separated names of the fields of each input record, in order")
+	optionalFields := fs.String("optional-fields", "", "comma-separated names of optional fields that may follow the treatment")
+	format := fs.String("format", "text", "reduce output formats, comma separated: text, json or csv")
+	sortBy := fs.String("sort", "key", "output order: key or count")
+	minCount := fs.Int("min-count", 0, "omit entries counted fewer than this many times")
+	topN := fs.Int("top", 0, "report only the N most common entries per category")
+	checksums := fs.Bool("checksums", false, "verify intermediate files against SHA-256 sidecars")
+	compress := fs.Bool("compress", false, "gzip intermediate and output files")
+	missingValues := fs.String("missing", "", "comma-separated placeholder diagnoses and treatments to count as unknown")
+	treatmentCategories := fs.String("treatment-categories", "", "comma-separated treatment=category pairs to count treatments by category")
+	unmappedTreatment := fs.String("unmapped-treatment", "", `category for treatments not in -treatment-categories, such as "other" (default unchanged)`)
+	excludeMissing := fs.Bool("exclude-missing", false, "drop records with a -missing placeholder instead of counting them")
+	maxLineBytes := fs.Int("max-line-bytes", 0, "longest input line accepted (default 64KiB)")
+	intermediateFormat := fs.String("intermediate-format", "text", "intermediate count file format: text or gob")
+	maxReduceMemory := fs.Int("max-reduce-memory", 0, "bytes a reduce task may use, merging intermediate files externally when set")
+	dedup := fs.Bool("dedup", false, "count each PatientID once per input file")
+	idPattern := fs.String("id-pattern", "", "skip records whose PatientID does not fully match this regexp")
+	validateAge := fs.Bool("validate-age", false, "skip records with an invalid age")
+	writeRejects := fs.Bool("rejects", false, "write skipped records and the reasons to rejects.txt")
+	skipHeader := fs.Bool("skip-header", false, "ignore the first line of each input file")
+	verbose := fs.Bool("v", false, "log task and phase events to stderr")
+	normalizeFields := fs.String("normalize", "", "comma-separated EHR fields to lowercase and trim (default Diagnosis,Treatment with -ignore-case)")
+	ignoreCase := fs.Bool("ignore-case", false, "count diagnoses and treatments case-insensitively")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *merge != "" {
+		return &command{merge: *merge, mergeInputs: fs.Args()}, nil
+	}
+	if *generate > 0 {
+		return &command{generate: *generate}, nil
+	}
+
+	var patientIDPattern *regexp.Regexp
+	if *idPattern != "" {
+		var err error
+		patientIDPattern, err = regexp.Compile("^(?:" + *idPattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ageBrackets []mapreduce.AgeBracket
+	if *ageBoundaries != "" {
+		var boundaries []int
+		for _, value := range splitList(*ageBoundaries) {
+			boundary, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid age boundary %q", value)
+			}
+			boundaries = append(boundaries, boundary)
+		}
+		var err error
+		ageBrackets, err = mapreduce.BracketsFromBoundaries(boundaries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var categories map[string]string
+	for _, pair := range splitList(*treatmentCategories) {
+		treatment, category, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid treatment category %q: want treatment=category", pair)
+		}
+		if categories == nil {
+			categories = make(map[string]string)
+		}
+		categories[treatment] = category
+	}
+
+	parser, err := mapreduce.NewParser(*inputFormat)
+	if err != nil {
+		return nil, err
+	}
+	// The value is unquoted so that escapes such as \t can be given
+	if strings.Contains(*fieldSep, `"`) {
+		return nil, fmt.Errorf("invalid -field-sep %q: a double quote cannot separate fields", *fieldSep)
+	}
+	sep, unquoteErr := strconv.Unquote(`"` + *fieldSep + `"`)
+	if unquoteErr != nil {
+		return nil, fmt.Errorf("invalid -field-sep %q: %w", *fieldSep, unquoteErr)
+	}
+	if sep == "" && isFlagSet(fs, "field-sep") {
+		return nil, fmt.Errorf("invalid -field-sep: field separator must not be empty")
+	}
+	if *inputFormat == "text" {
+		// Let FieldSep and OptionalFields configure the default parser
+		parser = nil
+	}
+
+	var filenames []string
+	if *input != "-" {
+		filenames, err = mapreduce.DiscoverInputs(*input, *recursive)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var inputReaders []io.Reader
+	if len(filenames) == 0 && (*input == "-" || stdinPiped()) {
+		filenames = []string{"stdin"}
+		inputReaders = []io.Reader{os.Stdin}
+	}
+	nMap := len(filenames)
+	if *nReduce < 1 {
+		return nil, fmt.Errorf("invalid -nreduce %d: need at least one reduce partition", *nReduce)
+	}
+
+	var runID string
+	if *timestamp {
+		runID = mapreduce.NewRunID()
+	}
+
+	mr := &mapreduce.MapReduce{
+		Files:               filenames,
+		InputReaders:        inputReaders,
+		NMap:                nMap,
+		NReduce:             *nReduce,
+		OutputDir:           *output,
+		Parser:              parser,
+		OptionalFields:      splitList(*optionalFields),
+		Schema:              splitList(*schema),
+		SkipHeader:          *skipHeader,
+		MaxLineBytes:        *maxLineBytes,
+		MaxReduceMemory:     *maxReduceMemory,
+		IntermediateFormat:  *intermediateFormat,
+		FieldSep:            sep,
+		Addr:                *addr,
+		MetricsAddr:         *metricsAddr,
+		SplitSize:           *splitSize,
+		DryRun:              *dryRun,
+		Force:               *force,
+		Incremental:         *incremental,
+		RunID:               runID,
+		Workers:             *workers,
+		Ordered:             *ordered,
+		JobTimeout:          *timeout,
+		GroupByAge:          *byAge,
+		AgeBrackets:         ageBrackets,
+		CrossTab:            *crossTab,
+		CountBySource:       *bySource,
+		AgeStats:            *ageStats,
+		NameCollisions:      *collisions,
+		IDConflicts:         *conflicts,
+		GroupByFields:       splitList(*groupBy),
+		OutputFormats:       splitList(*format),
+		SortBy:              *sortBy,
+		TopN:                *topN,
+		MinCount:            *minCount,
+		Compress:            *compress,
+		Checksums:           *checksums,
+		Dedup:               *dedup,
+		MissingValues:       splitList(*missingValues),
+		ExcludeMissing:      *excludeMissing,
+		TreatmentCategories: categories,
+		UnmappedTreatment:   *unmappedTreatment,
+		ValidateAge:         *validateAge,
+		WriteRejects:        *writeRejects,
+		PatientIDPattern:    patientIDPattern,
+		CaseInsensitive:     *ignoreCase,
+		NormalizeFields:     splitList(*normalizeFields),
+	}
+
+	if *stdout {
+		mr.OutputSink = mapreduce.WriterSink(os.Stdout)
+	}
+	if *verbose {
+		mr.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	return &command{mr: mr}, nil
+}
+
+func main() {
+	cmd, err := parseCommand(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cmd.merge != "" {
+		if err := mapreduce.MergeOutputs(cmd.mergeInputs, cmd.merge); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd.generate > 0 {
+		if err := mapreduce.GenerateEHR(os.Stdout, cmd.generate, 1); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	mr := cmd.mr
+	var tempDir string
+	if !mr.DryRun {
+		tempDir, err = os.MkdirTemp("", "mapreduce-")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mr.TempDir = tempDir
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := mapreduce.Run(ctx, mr)
+	if tempDir != "" && !mr.KeepIntermediate {
+		os.RemoveAll(tempDir)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep the summary off standard output when the counts are written there
+	summary := os.Stdout
+	if mr.OutputSink != nil {
+		summary = os.Stderr
+	}
+	switch {
+	case result.Plan != nil:
+		fmt.Print(result.Plan)
+	case result.UpToDate:
+		fmt.Fprintln(summary, "Inputs unchanged since the last run; use -force to rerun")
+	default:
+		fmt.Fprintln(summary, "All tasks are done")
+		fmt.Fprintf(summary, "Records: %d read, %d counted, %d skipped\n", result.Records.Read, result.Records.Counted, result.Records.Skipped)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parse runs parseCommand on args with a fresh flag set
+func parse(t *testing.T, args ...string) (*command, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("mapreduce", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseCommand(fs, args)
+}
+
+func TestParseCommand(t *testing.T) {
+	input := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(input, name), []byte("P001 John Smith 45 flu rest\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := t.TempDir()
+	cmd, err := parse(t, "-nreduce", "3", "-input", input, "-output", output, "-addr", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := cmd.mr
+	if mr.NReduce != 3 || mr.OutputDir != output || mr.Addr != "localhost:0" {
+		t.Errorf("NReduce = %d, OutputDir = %q, Addr = %q", mr.NReduce, mr.OutputDir, mr.Addr)
+	}
+	if mr.NMap != 2 || len(mr.Files) != 2 {
+		t.Errorf("NMap = %d, Files = %v, want the two inputs", mr.NMap, mr.Files)
+	}
+	if mr.Workers != 0 {
+		t.Errorf("Workers = %d by default, want 0 to pick the count automatically", mr.Workers)
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	input := t.TempDir()
+	if err := os.WriteFile(filepath.Join(input, "a.txt"), []byte("P001 John Smith 45 flu rest\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-nreduce", "0"}, "invalid -nreduce"},
+		{[]string{"-nreduce", "two"}, "invalid value"},
+		{[]string{"-age-boundaries", "18,x"}, "invalid age boundary"},
+		{[]string{"-treatment-categories", "rest"}, "invalid treatment category"},
+		{[]string{"-field-sep", ""}, "invalid -field-sep"},
+		{[]string{"-field-sep", `"`}, "double quote"},
+		{[]string{"-field-sep", `\q`}, "invalid -field-sep"},
+	} {
+		_, err := parse(t, append(test.args, "-input", input)...)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseCommand(%q) = %v, want an error containing %q", test.args, err, test.want)
+		}
+	}
+}
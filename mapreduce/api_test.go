@@ -0,0 +1,44 @@
+package mapreduce_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ashwinb039/Map-Reduce/mapreduce"
+)
+
+func TestExportedAPI(t *testing.T) {
+	ehr, err := mapreduce.ParseEHR("P001 John Smith 45 flu rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.Diagnosis != "flu" || ehr.Name != "John Smith" {
+		t.Fatalf("ParseEHR = %+v", ehr)
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "a.txt")
+	data := "P001 John Smith 45 flu rest\nP002 Jane Doe 30 cold fluids\nP003 Bob Jones 70 flu antiviral\n"
+	if err := os.WriteFile(input, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mr := &mapreduce.MapReduce{
+		Files:     []string{input},
+		NMap:      1,
+		NReduce:   2,
+		OutputDir: dir,
+		Addr:      ":0",
+	}
+	result, err := mapreduce.RunInMemory(context.Background(), mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Diagnosis["flu"] != 2 || result.Diagnosis["cold"] != 1 {
+		t.Errorf("Diagnosis = %v", result.Diagnosis)
+	}
+	if result.Records.Counted != 3 {
+		t.Errorf("Records = %+v", result.Records)
+	}
+}
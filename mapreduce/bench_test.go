@@ -0,0 +1,164 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchSizes are the input sizes, in records, each benchmark is run at
+var benchSizes = []int{1000, 10000, 100000}
+
+// benchJob writes n synthetic records to an input file and returns a
+// single-task job reading it
+func benchJob(b *testing.B, n int) *MapReduce {
+	b.Helper()
+	dir := b.TempDir()
+	input := filepath.Join(dir, "ehr.txt")
+	file, err := os.Create(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := GenerateEHR(file, n, 1); err != nil {
+		b.Fatal(err)
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(info.Size())
+	return &MapReduce{
+		Files:     []string{input},
+		NMap:      1,
+		NReduce:   1,
+		OutputDir: dir,
+		Addr:      ":0",
+		Logger:    slog.New(slog.DiscardHandler),
+	}
+}
+
+func BenchmarkMapTask(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			mr := benchJob(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mapOne(b, mr, 0)
+			}
+		})
+	}
+}
+
+func BenchmarkReduceTask(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			mr := benchJob(b, n)
+			mapAll(b, mr)
+			// Measure throughput over the intermediate files reduced
+			var size int64
+			for _, name := range intermediateFiles(b, mr.OutputDir) {
+				info, err := os.Stat(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size += info.Size()
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := reducePartition(context.Background(), 0, mr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEndToEnd(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			mr := benchJob(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := RunInMemory(context.Background(), mr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateEHR(t *testing.T) {
+	var first, again, other bytes.Buffer
+	if err := GenerateEHR(&first, 500, 7); err != nil {
+		t.Fatal(err)
+	}
+	GenerateEHR(&again, 500, 7)
+	GenerateEHR(&other, 500, 8)
+	if first.String() != again.String() {
+		t.Error("the same seed generated different records")
+	}
+	if first.String() == other.String() {
+		t.Error("different seeds generated the same records")
+	}
+
+	scanner := bufio.NewScanner(&first)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		ehr, err := ParseEHR(scanner.Text())
+		if err != nil {
+			t.Fatalf("line %d: %v", lines, err)
+		}
+		if want := fmt.Sprintf("P%06d", lines); ehr.PatientID != want {
+			t.Errorf("line %d: PatientID = %q, want %q", lines, ehr.PatientID, want)
+		}
+		if _, err := ParseAge(ehr.Age); err != nil {
+			t.Errorf("line %d: %v", lines, err)
+		}
+	}
+	if lines != 500 {
+		t.Errorf("generated %d lines, want 500", lines)
+	}
+}
+
+// distinctCounts returns n keys counted once each
+func distinctCounts(n int) map[string]int {
+	counts := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		counts[fmt.Sprintf("diagnosis-%06d", i)] = 1
+	}
+	return counts
+}
+
+// BenchmarkWriteIntermediate compares writeIntermediate's buffered writes
+// with a syscall per line
+func BenchmarkWriteIntermediate(b *testing.B) {
+	counts := distinctCounts(10000)
+	mr := &MapReduce{NReduce: 1, OutputDir: b.TempDir()}
+	b.Run("buffered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := writeIntermediate(mr, "diagnosis", "a.txt", 0, counts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unbuffered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			file, err := os.Create(filepath.Join(mr.OutputDir, "unbuffered.txt"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, key := range countKeys(counts) {
+				writeCountLine(mr, file, key, counts[key])
+			}
+			file.Close()
+		}
+	})
+}
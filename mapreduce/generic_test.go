@@ -0,0 +1,180 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// runGeneric runs a generic job over files and returns the key/result
+// pairs of every reduce partition
+func runGeneric(t *testing.T, mr *MapReduce) map[string]string {
+	t.Helper()
+	if err := RunGeneric(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]string)
+	for task := 0; task < mr.NReduce; task++ {
+		name, err := reduceOutputName(mr, task, "text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			key, value, ok := strings.Cut(line, " ")
+			if !ok {
+				t.Fatalf("malformed output line %q", line)
+			}
+			if _, dup := results[key]; dup {
+				t.Errorf("key %q written by more than one partition", key)
+			}
+			results[key] = value
+		}
+	}
+	return results
+}
+
+func TestWordCount(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t,
+		writeInput(t, dir, "a.txt", "the quick fox\nthe lazy dog\n"),
+		writeInput(t, dir, "b.txt", "the dog barks\n"))
+	mr.NReduce = 2
+	mr.Map = WordCountMap
+	mr.Reduce = CountReduce
+	want := map[string]string{"the": "3", "quick": "1", "fox": "1", "lazy": "1", "dog": "2", "barks": "1"}
+	if got := runGeneric(t, mr); !reflect.DeepEqual(got, want) {
+		t.Errorf("word counts = %v, want %v", got, want)
+	}
+}
+
+func TestGenericEHRCount(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.Map = EHRCountMap
+	mr.Reduce = CountReduce
+	want := map[string]string{
+		"diagnosis:flu": "2", "diagnosis:cold": "1",
+		"treatment:rest": "1", "treatment:fluids": "1", "treatment:antiviral": "1",
+	}
+	if got := runGeneric(t, mr); !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+}
+
+func TestAggregators(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P001 John Smith 45 flu rest\nP004 Ann Lee 12 flu rest\n")
+	for _, tc := range []struct {
+		name string
+		mapF MapFunc
+		agg  func() Aggregator
+		want map[string]string
+	}{
+		{"distinct", EHRPatientMap, NewDistinctAggregator, map[string]string{"diagnosis:flu": "3", "diagnosis:cold": "1"}},
+		{"min", EHRAgeMap, NewMinAggregator, map[string]string{"diagnosis:flu": "12", "diagnosis:cold": "30"}},
+		{"max", EHRAgeMap, NewMaxAggregator, map[string]string{"diagnosis:flu": "70", "diagnosis:cold": "30"}},
+	} {
+		mr := newTestJob(t, input)
+		mr.Map = tc.mapF
+		mr.Reduce = AggregateReduce(tc.agg)
+		if got := runGeneric(t, mr); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestShuffleGroupsValuesByKey(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t,
+		writeInput(t, dir, "a.txt", "x a1\ny a2\nx a3\n"),
+		writeInput(t, dir, "b.txt", "y b1\nx b2\n"),
+		writeInput(t, dir, "c.txt", "z c1\n"))
+	mr.NReduce = 2
+	// Each line "key value" emits its value under its key
+	mr.Map = func(filename, contents string) []KeyValue {
+		var kvs []KeyValue
+		for _, line := range strings.Split(strings.TrimSpace(contents), "\n") {
+			key, value, _ := strings.Cut(line, " ")
+			kvs = append(kvs, KeyValue{Key: key, Value: value})
+		}
+		return kvs
+	}
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	mr.Reduce = func(key string, values []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, dup := received[key]; dup {
+			t.Errorf("key %q reduced more than once", key)
+		}
+		sorted := slices.Clone(values)
+		slices.Sort(sorted)
+		received[key] = sorted
+		return strconv.Itoa(len(values))
+	}
+	runGeneric(t, mr)
+	want := map[string][]string{
+		"x": {"a1", "a3", "b2"},
+		"y": {"a2", "b1"},
+		"z": {"c1"},
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("reducer received %v, want %v", received, want)
+	}
+}
+
+func TestGenericHonoursRunIDAndCleansUp(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", "b a b\n"))
+	mr.Map = WordCountMap
+	mr.Reduce = CountReduce
+	mr.RunID = "r1"
+	want := map[string]string{"a": "1", "b": "2"}
+	if got := runGeneric(t, mr); !reflect.DeepEqual(got, want) {
+		t.Errorf("word counts = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(mr.OutputDir, "reduce-out-r1-0.txt")); err != nil {
+		t.Errorf("output not named for the run: %v", err)
+	}
+	if files := intermediateFiles(t, mr.intermediateDir()); len(files) != 0 {
+		t.Errorf("intermediates left behind: %v", files)
+	}
+}
+
+func TestGenericOutputSink(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", "b a b\n"))
+	mr.Map = WordCountMap
+	mr.Reduce = CountReduce
+	var out bytes.Buffer
+	mr.OutputSink = WriterSink(&out)
+	if err := RunGeneric(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "a 1\nb 2\n"; got != want {
+		t.Errorf("sink received %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(mr.OutputDir); len(entries) != 0 {
+		t.Errorf("output directory has %d entries, want none", len(entries))
+	}
+}
+
+func TestGenericCancelled(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", "a\n"))
+	mr.Map = WordCountMap
+	mr.Reduce = CountReduce
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RunGeneric(ctx, mr); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunGeneric = %v, want context.Canceled", err)
+	}
+}
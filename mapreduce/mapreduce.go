@@ -0,0 +1,4860 @@
+// Package mapreduce counts electronic health records with a MapReduce job
+// whose master hands map and reduce tasks to workers over RPC.
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// EHR represents an individual health record
+type EHR struct {
+	PatientID string `json:"patient_id"`
+	Name      string `json:"name"`
+	Age       string `json:"age"`
+	Diagnosis string `json:"diagnosis"`
+	Treatment string `json:"treatment"`
+	// Extra holds optional trailing fields present in the record, keyed by
+	// the names in OptionalFields
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// MapReduce structure
+type MapReduce struct {
+	Files   []string
+	NMap    int
+	NReduce int
+	// InputReaders, when set, are read by the map tasks instead of Files,
+	// one task per reader. Run names them "input-<i>" in Files if Files is
+	// empty. Each reader is consumed once, so they cannot be split or
+	// re-run by a re-queued task, and the run manifest is not written.
+	InputReaders []io.Reader
+	// NameTokens is the number of whitespace-separated tokens in a patient
+	// name. Zero means the default of a first and last name.
+	NameTokens int
+	// Parser parses input lines. Nil means a TextParser using NameTokens.
+	Parser RecordParser
+	// OptionalFields names fields that may follow Treatment, in order, such
+	// as "Physician". Records may omit any number of them from the end.
+	// They apply to the default text and FieldSep parsers and are kept in
+	// EHR.Extra, where GroupByFields and NormalizeFields may name them.
+	OptionalFields []string
+	// Schema, when set, names the fields of each input record in order and
+	// selects a SchemaParser, splitting on FieldSep or else on whitespace.
+	// Fields named like EHR fields fill them; the rest are kept in
+	// EHR.Extra, and GroupByFields and NormalizeFields may name any of them.
+	Schema []string
+	// SkipHeader drops the first line of each input file
+	SkipHeader bool
+	// TempDir holds intermediate map output. Empty means OutputDir.
+	TempDir string
+	// OutputDir holds reduce output, and intermediate output when TempDir
+	// is empty. Empty means the working directory. Run creates both
+	// directories if missing.
+	OutputDir string
+	// KeepIntermediate preserves intermediate files after a successful reduce
+	KeepIntermediate bool
+	// Checksums writes a SHA-256 sidecar beside each intermediate file, which
+	// reduce tasks verify before reading the file
+	Checksums bool
+	// SkipMissingIntermediate lets a reduce task log and skip a missing
+	// intermediate file instead of failing, producing partial results
+	SkipMissingIntermediate bool
+	// CombinerThreshold caps the distinct keys a map task holds in memory.
+	// Beyond it counts are spilled to disk and merged once the input is
+	// consumed. Zero keeps everything in memory.
+	CombinerThreshold int
+	// CombinerFanIn, when above one, has each reduce task first merge its
+	// intermediate files in a tree, CombinerFanIn at a time, so that it
+	// reads at most CombinerFanIn files per kind
+	CombinerFanIn int
+	// MaxReduceMemory is a hint, in bytes, for the memory a reduce task may
+	// use. When set, combining streams a k-way merge over the key-sorted
+	// intermediate files instead of summing them in a map, and unless
+	// CombinerFanIn is set it merges as many files at a time as fit in the
+	// hint. ReduceTask and reduce workers then write text and CSV outputs
+	// in key order straight from a final merge of the combined files, when
+	// no option needs all of a partition's counts at once (TopN, SortBy
+	// "count", GroupByAge, CrossTab, NameCollisions, IDConflicts or
+	// AgeStats). Run still gathers every count for its Result.
+	MaxReduceMemory int
+	// IntermediateFormat selects how map tasks write counts: "text" (the
+	// default) as quoted key and count lines, or "gob" as binary
+	// encoding/gob KeyCount values in .gob files, which are quicker to
+	// write and parse for large key sets
+	IntermediateFormat string
+	// Compress gzips intermediate files and reduce output, adding a .gz
+	// extension
+	Compress bool
+	// CaseInsensitive lowercases and trims diagnoses and treatments before
+	// counting so that spellings differing only in case collapse together
+	CaseInsensitive bool
+	// NormalizeFields names the EHR fields that are lowercased and trimmed,
+	// overriding the Diagnosis and Treatment normalized by CaseInsensitive
+	NormalizeFields []string
+	// MissingValues lists placeholder diagnoses and treatments, such as "NA",
+	// "-" or "", that are counted as "unknown" rather than literally
+	MissingValues []string
+	// ExcludeMissing drops records with a diagnosis or treatment in
+	// MissingValues instead of counting them as "unknown"
+	ExcludeMissing bool
+	// TreatmentCategories maps treatments to the category they are counted
+	// under, such as "ibuprofen" to "analgesics". Treatments missing from
+	// it are counted as UnmappedTreatment, or unchanged if that is empty.
+	// The "unknown" placeholder for MissingValues is left as is.
+	TreatmentCategories map[string]string
+	UnmappedTreatment   string
+	// ValidateAge skips records whose Age fails ParseAge, reporting them
+	// alongside other malformed records
+	ValidateAge bool
+	// PatientIDPattern, when set, skips records whose PatientID it does not
+	// match, reporting them alongside other malformed records. Anchor the
+	// pattern to require a full match.
+	PatientIDPattern *regexp.Regexp
+	// Filter, when set, restricts counting to records for which it returns
+	// true
+	Filter func(EHR) bool
+	// Dedup counts each PatientID once per map task, dropping repeats. The
+	// seen-set grows with the number of distinct patients in an input file
+	// and duplicates split across files are not detected.
+	Dedup bool
+	// DedupByDiagnosis keys Dedup on PatientID and Diagnosis, so a patient
+	// seen with several diagnoses is counted once for each
+	DedupByDiagnosis bool
+	// SplitSize, when positive, splits input files larger than this many
+	// bytes into line-aligned chunks that are mapped as separate,
+	// concurrent tasks. Each chunk is extended to the next line break so
+	// that no line is divided.
+	SplitSize int64
+	// Splits holds the byte range read by each map task once SplitInputs
+	// has run. Nil means each task reads its whole file.
+	Splits []InputSplit
+	// Incremental makes Run map only the input files added since the last
+	// run and add their counts to that run's totals, kept in OutputDir.
+	// If an earlier input changed or disappeared, or the options differ,
+	// every input is processed again.
+	Incremental bool
+	// Force makes Run process its inputs even when the manifest from the
+	// previous run shows nothing has changed
+	Force bool
+	// DryRun makes Run return the Plan for the job in Result.Plan without
+	// processing input or writing output
+	DryRun bool
+	// Addr is the master's RPC listen address for Run. Empty means
+	// DefaultAddr; ":0" picks a free port.
+	Addr string
+	// MetricsAddr, when set, is the address on which Run serves the
+	// master's metrics over HTTP in the Prometheus text format
+	MetricsAddr string
+	// MaxParallelMap bounds how many map tasks run at once, capping Workers
+	// for Run and the goroutines RunGeneric starts. Zero means no extra
+	// limit.
+	MaxParallelMap int
+	// MaxParallelReduce bounds how many reduce partitions Run processes at
+	// once. Zero runs them all concurrently.
+	MaxParallelReduce int
+	// Workers is the number of map workers Run starts. Zero means
+	// DefaultWorkers, or with SplitSize enough to map every split at once
+	// up to the number of CPUs.
+	Workers int
+	// MaxLineBytes is the longest input or intermediate line accepted. Zero
+	// means bufio.MaxScanTokenSize; longer lines stop the task with
+	// bufio.ErrTooLong.
+	MaxLineBytes int
+	// Ordered makes the master hand out map tasks strictly in index order,
+	// one at a time, and makes Run start a single worker, so that runs are
+	// reproducible. A re-queued task is retried before later tasks.
+	Ordered bool
+	// JobTimeout bounds how long Run may take. Once it passes, outstanding
+	// work is cancelled and Run returns an error wrapping
+	// context.DeadlineExceeded. Zero means no limit.
+	JobTimeout time.Duration
+	// TaskTimeout is how long a map task may stay unacknowledged before the
+	// master re-queues it for another worker. Zero disables re-queueing.
+	TaskTimeout time.Duration
+	// HeartbeatTimeout is how long a worker may go without a heartbeat
+	// before the master marks it dead and re-queues its map tasks. Zero
+	// disables liveness tracking.
+	HeartbeatTimeout time.Duration
+	// ReduceRetries is how many times RunReduceWorker asks again, every
+	// workerPollInterval, while map tasks are still in progress before it
+	// gives up. Zero means defaultReduceRetries.
+	ReduceRetries int
+	// GroupByAge additionally counts each diagnosis per age bracket
+	GroupByAge bool
+	// FieldSep, when set, separates the fields of input records, parsed by a
+	// DelimitedParser unless Parser is set, and separates keys from counts
+	// in intermediate and text output files. The default is whitespace.
+	FieldSep string
+	// WriteRejects makes Run write every skipped record to rejects.txt in
+	// OutputDir as "file:line: reason", a tab and the original line
+	WriteRejects bool
+	// AgeStats additionally reports the mean and median age of patients with
+	// each diagnosis. Records whose age fails ParseAge are left out.
+	AgeStats bool
+	// AgeBrackets overrides DefaultAgeBrackets when GroupByAge is set
+	AgeBrackets []AgeBracket
+	// NameCollisions additionally reports names shared by more than one
+	// PatientID, which may indicate data entry errors
+	NameCollisions bool
+	// IDConflicts additionally reports PatientIDs seen with differing
+	// names, ages or diagnoses. Records are compared before Dedup.
+	IDConflicts bool
+	// GroupByFields names the EHR fields that are counted, each in its own
+	// output section. Empty means Diagnosis and Treatment.
+	GroupByFields []string
+	// CrossTab additionally counts each diagnosis and treatment pair
+	CrossTab bool
+	// CountBySource additionally counts the records taken from each input
+	// file, for auditing where the counts came from
+	CountBySource bool
+	// RunID, when set, is added to reduce output names, as in
+	// reduce-out-<RunID>-0.txt, so that runs do not overwrite each other
+	RunID string
+	// MergeOutput makes Run write the counts of every reduce partition to a
+	// single reduce-out file instead of one file per partition. TopN then
+	// applies across the whole job.
+	MergeOutput bool
+	// OutputSink, when set, is called with the name of each reduce output
+	// and writes the output in place of the named file, so that results can
+	// be streamed to stdout, a network response or remote storage. Output
+	// written to a sink is never compressed.
+	OutputSink func(name string) (io.WriteCloser, error)
+	// OutputFormat selects the reduce output encoding: "text" (the default),
+	// "json" or "csv"
+	OutputFormat string
+	// OutputFormats, when set, overrides OutputFormat with several formats
+	// written in the same pass, such as reduce-out-0.txt and
+	// reduce-out-0.json
+	OutputFormats []string
+	// SortBy orders text and CSV output entries: "key" (the default) sorts
+	// alphabetically, "count" by descending count with ties broken by key
+	SortBy string
+	// TopN limits each output category to its N highest counts, ties broken
+	// by key. Zero reports every entry. Limits apply per reduce partition.
+	TopN int
+	// MinCount drops output entries counted fewer than MinCount times. It
+	// is applied after reduction, before TopN.
+	MinCount int
+	// Logger receives structured events for task assignment and completion,
+	// skipped records and phase transitions. Nil discards them, except
+	// skipped records which go to the standard logger.
+	Logger *slog.Logger
+	// OnProgress, when set, is called by Run each time a map or reduce task
+	// completes, with phase "map" or "reduce". Calls are not concurrent.
+	OnProgress func(phase string, done, total int)
+	// OnBytesProgress, when set, is called as each map task consumes its
+	// input with the bytes read so far and the size of the file or split,
+	// or -1 for an InputReader. It is called about every MiB and once more
+	// at the end of the input, when read equals size. Calls from different
+	// map tasks may be concurrent.
+	OnBytesProgress func(filename string, read, size int64)
+	// Map and Reduce define a job for the generic RunGeneric engine
+	Map    MapFunc
+	Reduce ReduceFunc
+}
+
+// intermediateDir returns the directory for intermediate and spill files
+func (mr *MapReduce) intermediateDir() string {
+	if mr.TempDir != "" {
+		return mr.TempDir
+	}
+	return mr.OutputDir
+}
+
+// makeDirs creates the output and intermediate directories if missing
+func (mr *MapReduce) makeDirs() error {
+	for _, dir := range []string{mr.OutputDir, mr.TempDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardLogger is used when MapReduce.Logger is nil
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// logger returns mr.Logger, or a logger that discards events if unset
+func (mr *MapReduce) logger() *slog.Logger {
+	if mr.Logger == nil {
+		return discardLogger
+	}
+	return mr.Logger
+}
+
+// skipRecord reports a record dropped by MapTask to Logger, or to the
+// standard logger if Logger is unset
+func (mr *MapReduce) skipRecord(filename string, line int, err error) {
+	if mr.Logger == nil {
+		log.Printf("skipping record at %v", &ParseError{File: filename, Line: line, Err: err})
+		return
+	}
+	mr.Logger.Warn("record skipped", "file", filename, "line", line, "error", err)
+}
+
+// maxParallelMap returns n capped at MaxParallelMap, if set
+func (mr *MapReduce) maxParallelMap(n int) int {
+	if mr.MaxParallelMap > 0 && mr.MaxParallelMap < n {
+		return mr.MaxParallelMap
+	}
+	return n
+}
+
+// progress reports a completed task to OnProgress, if set
+func (mr *MapReduce) progress(phase string, done, total int) {
+	if mr.OnProgress != nil {
+		mr.OnProgress(phase, done, total)
+	}
+}
+
+// intermediateKinds lists every category of intermediate file a map task
+// may write
+var intermediateKinds = []string{"patientid", "name", "age", "diagnosis", "treatment", "agebracket", "crosstab", "nameids", "source", "agestats", "idrecords", "rejects", "kv"}
+
+// ehrFields maps each EHR field name accepted by GroupByFields to its
+// accessor
+var ehrFields = map[string]func(EHR) string{
+	"PatientID": func(ehr EHR) string { return ehr.PatientID },
+	"Name":      func(ehr EHR) string { return ehr.Name },
+	"Age":       func(ehr EHR) string { return ehr.Age },
+	"Diagnosis": func(ehr EHR) string { return ehr.Diagnosis },
+	"Treatment": func(ehr EHR) string { return ehr.Treatment },
+}
+
+// defaultGroupByFields are the fields counted when GroupByFields is empty
+var defaultGroupByFields = []string{"Diagnosis", "Treatment"}
+
+// groupByFields returns the EHR fields the job counts
+func (mr *MapReduce) groupByFields() []string {
+	if len(mr.GroupByFields) == 0 {
+		return defaultGroupByFields
+	}
+	return mr.GroupByFields
+}
+
+// fieldKind returns the intermediate kind holding counts of an EHR field
+func fieldKind(field string) string {
+	return strings.ToLower(field)
+}
+
+// validateFields reports an error if GroupByFields names an unknown field
+func (mr *MapReduce) validateFields() error {
+	for _, field := range mr.GroupByFields {
+		if !mr.knownField(field) {
+			return fmt.Errorf("unknown group-by field %q", field)
+		}
+	}
+	for _, field := range mr.NormalizeFields {
+		if !mr.knownField(field) {
+			return fmt.Errorf("unknown normalize field %q", field)
+		}
+	}
+	return nil
+}
+
+// knownField reports whether field is an EHR field or one named by Schema
+// or OptionalFields
+func (mr *MapReduce) knownField(field string) bool {
+	if ehrFields[field] != nil {
+		return true
+	}
+	for _, fields := range [][]string{mr.Schema, mr.OptionalFields} {
+		for _, f := range fields {
+			if f == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldValue returns the value of an EHR field, or of an extra field kept
+// from the record
+func fieldValue(ehr EHR, field string) string {
+	if get := ehrFields[field]; get != nil {
+		return get(ehr)
+	}
+	return ehr.Extra[field]
+}
+
+// normalizeFields returns the EHR fields the job normalizes with
+// normalizeKey
+func (mr *MapReduce) normalizeFields() []string {
+	if len(mr.NormalizeFields) > 0 {
+		return mr.NormalizeFields
+	}
+	if mr.CaseInsensitive {
+		return []string{"Diagnosis", "Treatment"}
+	}
+	return nil
+}
+
+// outputFormats returns the formats reduce output is written in
+func (mr *MapReduce) outputFormats() []string {
+	if len(mr.OutputFormats) > 0 {
+		return mr.OutputFormats
+	}
+	if mr.OutputFormat != "" {
+		return []string{mr.OutputFormat}
+	}
+	return []string{"text"}
+}
+
+// normalizes reports whether the job normalizes field
+func (mr *MapReduce) normalizes(field string) bool {
+	for _, f := range mr.normalizeFields() {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRecord applies normalizeKey to the named fields of ehr
+func normalizeRecord(ehr *EHR, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case "PatientID":
+			ehr.PatientID = normalizeKey(ehr.PatientID)
+		case "Name":
+			ehr.Name = normalizeKey(ehr.Name)
+		case "Age":
+			ehr.Age = normalizeKey(ehr.Age)
+		case "Diagnosis":
+			ehr.Diagnosis = normalizeKey(ehr.Diagnosis)
+		case "Treatment":
+			ehr.Treatment = normalizeKey(ehr.Treatment)
+		default:
+			if value, ok := ehr.Extra[field]; ok {
+				ehr.Extra[field] = normalizeKey(value)
+			}
+		}
+	}
+}
+
+// kindCounts holds a task's counts per intermediate kind, then per key
+type kindCounts map[string]map[string]int
+
+// kinds returns the intermediate kinds produced by the EHR job
+func (mr *MapReduce) kinds() []string {
+	var kinds []string
+	for _, field := range mr.groupByFields() {
+		kinds = append(kinds, fieldKind(field))
+	}
+	if mr.GroupByAge {
+		kinds = append(kinds, "agebracket")
+	}
+	if mr.CrossTab {
+		kinds = append(kinds, "crosstab")
+	}
+	if mr.NameCollisions {
+		kinds = append(kinds, "nameids")
+	}
+	if mr.IDConflicts {
+		kinds = append(kinds, "idrecords")
+	}
+	if mr.CountBySource {
+		kinds = append(kinds, "source")
+	}
+	if mr.AgeStats {
+		kinds = append(kinds, "agestats")
+	}
+	return kinds
+}
+
+// newCounts returns empty counts for each of mr's kinds
+func (mr *MapReduce) newCounts() kindCounts {
+	counts := make(kindCounts)
+	for _, kind := range mr.kinds() {
+		counts[kind] = make(map[string]int)
+	}
+	return counts
+}
+
+// size returns the number of distinct keys across all kinds
+func (c kindCounts) size() int {
+	n := 0
+	for _, counts := range c {
+		n += len(counts)
+	}
+	return n
+}
+
+// AgeBracket is an inclusive range of ages reported under Label
+type AgeBracket struct {
+	Label string
+	Min   int
+	Max   int
+}
+
+// DefaultAgeBrackets is used when GroupByAge is set without AgeBrackets
+var DefaultAgeBrackets = []AgeBracket{
+	{Label: "0-17", Min: 0, Max: 17},
+	{Label: "18-39", Min: 18, Max: 39},
+	{Label: "40-64", Min: 40, Max: 64},
+	{Label: "65+", Min: 65, Max: math.MaxInt},
+}
+
+// BracketsFromBoundaries returns the brackets split at the given ages, so
+// that boundaries 18, 40 and 65 produce 0-17, 18-39, 40-64 and 65+. The
+// boundaries must be positive and strictly ascending.
+func BracketsFromBoundaries(boundaries []int) ([]AgeBracket, error) {
+	if len(boundaries) == 0 {
+		return nil, fmt.Errorf("no age boundaries given")
+	}
+	brackets := make([]AgeBracket, 0, len(boundaries)+1)
+	min := 0
+	for _, boundary := range boundaries {
+		if boundary <= min {
+			return nil, fmt.Errorf("age boundaries %v are not positive and ascending", boundaries)
+		}
+		brackets = append(brackets, AgeBracket{Label: fmt.Sprintf("%d-%d", min, boundary-1), Min: min, Max: boundary - 1})
+		min = boundary
+	}
+	return append(brackets, AgeBracket{Label: fmt.Sprintf("%d+", min), Min: min, Max: math.MaxInt}), nil
+}
+
+// unknownAgeBracket labels records whose age is unparsable or unbracketed
+const unknownAgeBracket = "unknown"
+
+// unknownValue replaces diagnoses and treatments listed in MissingValues
+const unknownValue = "unknown"
+
+// missingValues returns MissingValues as a set, including their normalized
+// forms if the diagnoses or treatments they are matched against are
+// normalized
+func (mr *MapReduce) missingValues() map[string]bool {
+	normalize := mr.normalizes("Diagnosis") || mr.normalizes("Treatment")
+	missing := make(map[string]bool, len(mr.MissingValues))
+	for _, value := range mr.MissingValues {
+		missing[value] = true
+		if normalize {
+			missing[normalizeKey(value)] = true
+		}
+	}
+	return missing
+}
+
+// treatmentCategories returns TreatmentCategories with its treatments
+// normalized like the values they are matched against, or nil if unset
+func (mr *MapReduce) treatmentCategories() map[string]string {
+	if mr.TreatmentCategories == nil {
+		return nil
+	}
+	categories := make(map[string]string, len(mr.TreatmentCategories))
+	for treatment, category := range mr.TreatmentCategories {
+		if mr.normalizes("Treatment") {
+			treatment = normalizeKey(treatment)
+		}
+		categories[treatment] = category
+	}
+	return categories
+}
+
+// ageBrackets returns the configured brackets or the defaults
+func (mr *MapReduce) ageBrackets() []AgeBracket {
+	if len(mr.AgeBrackets) > 0 {
+		return mr.AgeBrackets
+	}
+	return DefaultAgeBrackets
+}
+
+// maxAge is the oldest age accepted by ParseAge
+const maxAge = 150
+
+// ParseAge parses an age in whole years between 0 and maxAge
+func ParseAge(age string) (int, error) {
+	n, err := strconv.Atoi(age)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	if n < 0 || n > maxAge {
+		return 0, fmt.Errorf("age %d out of range 0-%d", n, maxAge)
+	}
+	return n, nil
+}
+
+// ageBracket returns the label of the bracket containing age
+func (mr *MapReduce) ageBracket(age string) string {
+	n, err := ParseAge(age)
+	if err != nil {
+		return unknownAgeBracket
+	}
+	for _, bracket := range mr.ageBrackets() {
+		if n >= bracket.Min && n <= bracket.Max {
+			return bracket.Label
+		}
+	}
+	return unknownAgeBracket
+}
+
+// parser returns the configured RecordParser or the default text parser
+func (mr *MapReduce) parser() RecordParser {
+	if mr.Parser != nil {
+		return mr.Parser
+	}
+	if len(mr.Schema) > 0 {
+		return SchemaParser{Fields: mr.Schema, Sep: mr.FieldSep}
+	}
+	if mr.FieldSep != "" {
+		return DelimitedParser{Sep: mr.FieldSep, OptionalFields: mr.OptionalFields}
+	}
+	return TextParser{NameTokens: mr.NameTokens, OptionalFields: mr.OptionalFields}
+}
+
+// newScanner returns a line scanner for r that accepts lines of up to
+// MaxLineBytes
+func (mr *MapReduce) newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if mr.MaxLineBytes > 0 {
+		scanner.Buffer(make([]byte, 0, min(mr.MaxLineBytes, bufio.MaxScanTokenSize)), mr.MaxLineBytes)
+	}
+	return scanner
+}
+
+// fieldSep returns FieldSep, or a space if it is unset
+func (mr *MapReduce) fieldSep() string {
+	if mr.FieldSep != "" {
+		return mr.FieldSep
+	}
+	return " "
+}
+
+// defaultNameTokens is the name length assumed when NameTokens is unset
+const defaultNameTokens = 2
+
+// DefaultWorkers is the number of map workers used when Workers is unset
+const DefaultWorkers = 2
+
+// DefaultAddr is the master's listen address when none is configured
+const DefaultAddr = ":1234"
+
+// Master structure
+type Master struct {
+	// Addr is the address Serve listens on. Once serving it holds the
+	// dialable address, including the port chosen for ":0".
+	Addr string
+
+	ctx         context.Context
+	mr          *MapReduce
+	taskTimeout time.Duration
+	mapTasks    chan int
+	reduceTasks chan int
+	done        chan struct{}
+	doneOnce    sync.Once
+
+	// mu guards the fields below, which are shared by concurrent RPC
+	// handlers, the reaper and Shutdown
+	mu           sync.Mutex
+	mapDone      map[int]bool
+	reduceDone   map[int]bool
+	mapAssigned  map[int]time.Time
+	mapOwner     map[int]string
+	lastSeen     map[string]time.Time
+	deadWorkers  map[string]bool
+	stats        MasterStats
+	requeued     int
+	mapsComplete chan struct{}
+	listener     net.Listener
+	conns        map[net.Conn]bool
+	shutdown     bool
+}
+
+// MasterStats reports how many map and reduce tasks were assigned to each
+// worker
+type MasterStats struct {
+	MapTasks    map[string]int
+	ReduceTasks map[string]int
+	// Records sums the RecordStats of completed map tasks per input file
+	Records map[string]RecordStats
+}
+
+// RecordStats counts the records a map task read. Records that were read
+// but neither counted nor skipped were dropped by Filter or Dedup.
+type RecordStats struct {
+	Read    int
+	Counted int
+	// Skipped records failed to parse or validate
+	Skipped int
+}
+
+// add returns the sum of two RecordStats
+func (r RecordStats) add(o RecordStats) RecordStats {
+	return RecordStats{Read: r.Read + o.Read, Counted: r.Counted + o.Counted, Skipped: r.Skipped + o.Skipped}
+}
+
+// MapResult is sent by MapTask once it finishes
+type MapResult struct {
+	RecordStats
+	Err error
+}
+
+// CompleteArgs reports a finished map task and its record counts
+type CompleteArgs struct {
+	Task  int
+	Stats RecordStats
+}
+
+// TaskArgs identifies the worker requesting a task
+type TaskArgs struct {
+	WorkerID string
+}
+
+// ParseEHR function to parse a line of EHR data
+func ParseEHR(line string) (EHR, error) {
+	return ParseEHRNames(line, defaultNameTokens)
+}
+
+// ParseEHRNames parses a line of EHR data whose name spans nameTokens tokens
+func ParseEHRNames(line string, nameTokens int) (EHR, error) {
+	return parseEHRFields(line, nameTokens, nil)
+}
+
+// parseEHRFields parses a line of EHR data whose name spans nameTokens
+// tokens and which may end with some of the optional fields
+func parseEHRFields(line string, nameTokens int, optional []string) (EHR, error) {
+	if nameTokens < 1 {
+		return EHR{}, fmt.Errorf("invalid name token count %d", nameTokens)
+	}
+	fields, quoted, err := tokenize(line)
+	if err != nil {
+		return EHR{}, err
+	}
+	if len(fields) >= 5 && len(fields) <= 5+len(optional) && quoted[1] {
+		// A quoted name is a single field whatever its number of words
+		nameTokens = 1
+	}
+	want := nameTokens + 4
+	if err := checkFieldCount(line, len(fields), want, optional); err != nil {
+		return EHR{}, err
+	}
+	n := 1 + nameTokens
+	return EHR{
+		PatientID: fields[0],
+		Name:      strings.Join(fields[1:n], " "),
+		Age:       fields[n],
+		Diagnosis: fields[n+1],
+		Treatment: fields[n+2],
+		Extra:     extraFields(fields[want:], optional),
+	}, nil
+}
+
+// checkFieldCount checks that a record has the want required fields and no
+// more optional ones than are named
+func checkFieldCount(line string, got, want int, optional []string) error {
+	if len(optional) == 0 && got != want {
+		return fmt.Errorf("expected %d fields, got %d: %q", want, got, line)
+	}
+	if got < want || got > want+len(optional) {
+		return fmt.Errorf("expected %d to %d fields, got %d: %q", want, want+len(optional), got, line)
+	}
+	return nil
+}
+
+// extraFields maps trailing field values to the optional field names
+func extraFields(values, optional []string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	extra := make(map[string]string, len(values))
+	for i, value := range values {
+		extra[optional[i]] = value
+	}
+	return extra
+}
+
+// tokenize splits line on whitespace like strings.Fields, except that a
+// token starting with a double quote runs to the closing quote and may
+// contain whitespace. Within quotes \" is a literal quote. quoted reports
+// which tokens were quoted; their quotes are removed.
+func tokenize(line string) (tokens []string, quoted []bool, err error) {
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+		if r != '"' {
+			end := strings.IndexFunc(line[i:], unicode.IsSpace)
+			if end < 0 {
+				end = len(line) - i
+			}
+			tokens = append(tokens, line[i:i+end])
+			quoted = append(quoted, false)
+			i += end
+			continue
+		}
+
+		var b strings.Builder
+		closed := false
+		for i++; i < len(line); i++ {
+			if line[i] == '\\' && i+1 < len(line) && line[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+			} else if line[i] == '"' {
+				closed = true
+				i++
+				break
+			} else {
+				b.WriteByte(line[i])
+			}
+		}
+		if !closed {
+			return nil, nil, fmt.Errorf("unterminated quote: %q", line)
+		}
+		if i < len(line) {
+			if r, _ := utf8.DecodeRuneInString(line[i:]); !unicode.IsSpace(r) {
+				return nil, nil, fmt.Errorf("closing quote not followed by space: %q", line)
+			}
+		}
+		tokens = append(tokens, b.String())
+		quoted = append(quoted, true)
+	}
+	return tokens, quoted, nil
+}
+
+// RecordParser parses a single line of input into an EHR
+type RecordParser interface {
+	Parse(line string) (EHR, error)
+}
+
+// TextParser parses whitespace-delimited EHR lines. Double-quoted fields
+// may contain spaces.
+type TextParser struct {
+	// NameTokens is the number of tokens in a patient name, defaulting to 2
+	NameTokens int
+	// OptionalFields names fields that may follow Treatment
+	OptionalFields []string
+}
+
+// Parse implements RecordParser
+func (p TextParser) Parse(line string) (EHR, error) {
+	nameTokens := p.NameTokens
+	if nameTokens == 0 {
+		nameTokens = defaultNameTokens
+	}
+	return parseEHRFields(line, nameTokens, p.OptionalFields)
+}
+
+// CSVParser parses comma-separated EHR lines in the column order
+// PatientID, Name, Age, Diagnosis, Treatment. Quoted fields may contain
+// commas but not newlines, since input is read a line at a time.
+type CSVParser struct{}
+
+// Parse implements RecordParser
+func (CSVParser) Parse(line string) (EHR, error) {
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return EHR{}, fmt.Errorf("invalid csv record %q: %v", line, err)
+	}
+	if len(fields) != 5 {
+		return EHR{}, fmt.Errorf("expected 5 fields, got %d: %q", len(fields), line)
+	}
+	return EHR{
+		PatientID: fields[0],
+		Name:      fields[1],
+		Age:       fields[2],
+		Diagnosis: fields[3],
+		Treatment: fields[4],
+	}, nil
+}
+
+// TSVParser parses tab-separated EHR lines in the column order PatientID,
+// Name, Age, Diagnosis, Treatment. Fields may contain spaces.
+type TSVParser struct{}
+
+// Parse implements RecordParser
+func (TSVParser) Parse(line string) (EHR, error) {
+	return DelimitedParser{Sep: "\t"}.Parse(line)
+}
+
+// DelimitedParser parses EHR lines whose fields, in the column order
+// PatientID, Name, Age, Diagnosis, Treatment, are separated by Sep
+type DelimitedParser struct {
+	Sep string
+	// OptionalFields names fields that may follow Treatment
+	OptionalFields []string
+}
+
+// Parse implements RecordParser
+func (p DelimitedParser) Parse(line string) (EHR, error) {
+	if p.Sep == "" {
+		return EHR{}, fmt.Errorf("empty field separator")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r"), p.Sep)
+	if err := checkFieldCount(line, len(fields), 5, p.OptionalFields); err != nil {
+		return EHR{}, err
+	}
+	return EHR{
+		PatientID: fields[0],
+		Name:      fields[1],
+		Age:       fields[2],
+		Diagnosis: fields[3],
+		Treatment: fields[4],
+		Extra:     extraFields(fields[5:], p.OptionalFields),
+	}, nil
+}
+
+// NewParser returns the RecordParser for an input format: "text", "csv",
+// "tsv" or "json"
+func NewParser(format string) (RecordParser, error) {
+	switch format {
+	case "", "text":
+		return TextParser{}, nil
+	case "csv":
+		return CSVParser{}, nil
+	case "tsv":
+		return TSVParser{}, nil
+	case "json":
+		return JSONParser{}, nil
+	}
+	return nil, fmt.Errorf("unknown input format %q", format)
+}
+
+// SchemaParser parses records whose fields are named, in order, by Fields
+type SchemaParser struct {
+	Fields []string
+	// Sep separates fields. Empty means runs of whitespace.
+	Sep string
+}
+
+// Parse implements RecordParser
+func (p SchemaParser) Parse(line string) (EHR, error) {
+	record, err := ParseRecord(line, p.Fields, p.Sep)
+	if err != nil {
+		return EHR{}, err
+	}
+	var ehr EHR
+	for field, value := range record {
+		switch field {
+		case "PatientID":
+			ehr.PatientID = value
+		case "Name":
+			ehr.Name = value
+		case "Age":
+			ehr.Age = value
+		case "Diagnosis":
+			ehr.Diagnosis = value
+		case "Treatment":
+			ehr.Treatment = value
+		default:
+			if ehr.Extra == nil {
+				ehr.Extra = make(map[string]string)
+			}
+			ehr.Extra[field] = value
+		}
+	}
+	return ehr, nil
+}
+
+// ParseRecord splits line on sep, or on whitespace if sep is empty, and
+// maps each field to its name in schema
+func ParseRecord(line string, schema []string, sep string) (map[string]string, error) {
+	var fields []string
+	if sep == "" {
+		fields = strings.Fields(line)
+	} else {
+		fields = strings.Split(strings.TrimSuffix(line, "\r"), sep)
+	}
+	if len(fields) != len(schema) {
+		return nil, fmt.Errorf("expected %d fields, got %d: %q", len(schema), len(fields), line)
+	}
+	record := make(map[string]string, len(schema))
+	for i, field := range schema {
+		record[field] = fields[i]
+	}
+	return record, nil
+}
+
+// JSONParser parses newline-delimited JSON with one EHR object per line.
+// Unknown fields are ignored.
+type JSONParser struct{}
+
+// Parse implements RecordParser
+func (JSONParser) Parse(line string) (EHR, error) {
+	var ehr EHR
+	if err := json.Unmarshal([]byte(line), &ehr); err != nil {
+		return EHR{}, fmt.Errorf("invalid json record %q: %v", line, err)
+	}
+	return ehr, nil
+}
+
+// intermediateName returns the path of a map task's intermediate file for
+// kind (such as "diagnosis" or "treatment") and reduce partition. The input
+// filename is hashed so that paths with directories or colliding basenames
+// map to distinct files.
+func intermediateName(mr *MapReduce, kind string, filename string, task int, partition int) string {
+	return filepath.Join(mr.intermediateDir(), fmt.Sprintf("map-%s-%08x-%d-%d.%s%s", kind, fileHash(filename), task, partition, intermediateExt(mr, kind), compressExt(mr)))
+}
+
+// intermediateExt returns the extension of count files of kind in mr's
+// IntermediateFormat. Rejected lines and generic pairs are always text.
+func intermediateExt(mr *MapReduce, kind string) string {
+	if mr.IntermediateFormat == "gob" && kind != "rejects" && kind != "kv" {
+		return "gob"
+	}
+	return "txt"
+}
+
+// compressExt returns the extension appended to compressed files
+func compressExt(mr *MapReduce) string {
+	if mr.Compress {
+		return ".gz"
+	}
+	return ""
+}
+
+// spillName returns the path of a map task's nth combiner spill for kind
+func spillName(mr *MapReduce, kind string, filename string, task int, n int) string {
+	return filepath.Join(mr.intermediateDir(), fmt.Sprintf("spill-%s-%08x-%d-%d.%s", kind, fileHash(filename), task, n, intermediateExt(mr, kind)))
+}
+
+// fileHash hashes an input filename for use in intermediate file names
+func fileHash(filename string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	return h.Sum32()
+}
+
+// spillCounts writes the counts of each kind to the map task's nth spill
+func spillCounts(mr *MapReduce, filename string, task int, n int, counts kindCounts) error {
+	for kind, keyCounts := range counts {
+		file, err := os.Create(spillName(mr, kind, filename, task, n))
+		if err != nil {
+			return err
+		}
+		w := newCountWriter(mr, file)
+		for key, count := range keyCounts {
+			w.write(key, count)
+		}
+		if err := w.Flush(); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeSpills adds the counts from a map task's spills back into counts and
+// removes the spill files
+func mergeSpills(mr *MapReduce, filename string, task int, spills int, counts kindCounts) error {
+	for n := 0; n < spills; n++ {
+		for kind, keyCounts := range counts {
+			name := spillName(mr, kind, filename, task, n)
+			if err := readCounts(mr, name, keyCounts); err != nil {
+				return err
+			}
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ihash selects the reduce partition for a key as ihash(key) % NReduce
+func ihash(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// partition returns the reduce partition of a key. Name and PatientID pairs
+// are routed by name so that every ID for a name meets in one partition,
+// diagnosis and age pairs by diagnosis so that its ages meet, and records
+// by PatientID.
+func partition(mr *MapReduce, kind string, key string) int {
+	switch kind {
+	case "nameids", "agestats":
+		key = key[:strings.LastIndexByte(key, '|')]
+	case "idrecords":
+		key, _, _ = strings.Cut(key, "|")
+	}
+	return ihash(key) % mr.NReduce
+}
+
+// writeIntermediate writes counts for a map task in key order, routing
+// each key to the file of its reduce partition
+func writeIntermediate(mr *MapReduce, kind string, filename string, task int, counts map[string]int) error {
+	files := make([]io.WriteCloser, mr.NReduce)
+	writers := make([]*countWriter, mr.NReduce)
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for r := range files {
+		file, err := createOutput(mr, intermediateName(mr, kind, filename, task, r))
+		if err != nil {
+			return err
+		}
+		files[r] = file
+		writers[r] = newCountWriter(mr, file)
+	}
+
+	for _, key := range countKeys(counts) {
+		writers[partition(mr, kind, key)].write(key, counts[key])
+	}
+
+	for r, file := range files {
+		if err := writers[r].Flush(); err != nil {
+			return err
+		}
+		files[r] = nil
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if mr.Checksums {
+			if err := writeChecksum(intermediateName(mr, kind, filename, task, r)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumExt is appended to an intermediate file's name to form the name
+// of its checksum sidecar
+const checksumExt = ".sha256"
+
+// fileChecksum returns the hex SHA-256 of the named file's contents
+func fileChecksum(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksum writes the sidecar holding the named file's checksum, in
+// the format of sha256sum
+func writeChecksum(name string) error {
+	sum, err := fileChecksum(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name+checksumExt, []byte(sum+"  "+filepath.Base(name)+"\n"), 0644)
+}
+
+// verifyChecksum reports an error if the named file does not match its
+// checksum sidecar
+func verifyChecksum(name string) error {
+	data, err := ioutil.ReadFile(name + checksumExt)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file %s%s", name, checksumExt)
+	}
+	sum, err := fileChecksum(name)
+	if err != nil {
+		return err
+	}
+	if sum != fields[0] {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, fields[0], sum)
+	}
+	return nil
+}
+
+// Value pools GenerateEHR draws synthetic records from
+var (
+	sampleFirstNames = []string{"John", "Jane", "Bob", "Alice", "Maria", "Wei", "Amit", "Sara"}
+	sampleLastNames  = []string{"Smith", "Doe", "Jones", "Garcia", "Chen", "Patel", "Brown", "Kim"}
+	sampleDiagnoses  = []string{"flu", "cold", "asthma", "diabetes", "hypertension", "migraine"}
+	sampleTreatments = []string{"rest", "fluids", "antiviral", "inhaler", "insulin", "surgery"}
+)
+
+// GenerateEHR writes n synthetic EHR lines to w for measuring how a job
+// scales with input size. The same seed always yields the same records.
+func GenerateEHR(w io.Writer, n int, seed int64) error {
+	rng := rand.New(rand.NewSource(seed))
+	bw := bufio.NewWriter(w)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(bw, "P%06d %s %s %d %s %s\n", i+1,
+			sampleFirstNames[rng.Intn(len(sampleFirstNames))],
+			sampleLastNames[rng.Intn(len(sampleLastNames))],
+			rng.Intn(maxAge+1),
+			sampleDiagnoses[rng.Intn(len(sampleDiagnoses))],
+			sampleTreatments[rng.Intn(len(sampleTreatments))])
+	}
+	return bw.Flush()
+}
+
+// openInput opens an input file, transparently decompressing gzip data
+func openInput(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newInputReader(filename, file, file)
+}
+
+// newInputReader reads the file opened as file through r, transparently
+// decompressing gzip data
+func newInputReader(filename string, r io.Reader, file io.Closer) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, &IOError{Op: "read", Path: filename, Err: err}
+		}
+		return &inputReader{Reader: gz, closers: closers{gz, file}}, nil
+	}
+	return &inputReader{Reader: br, closers: closers{file}}, nil
+}
+
+// createOutput creates name for writing, gzip-compressing the data when
+// mr.Compress is set
+func createOutput(mr *MapReduce, name string) (io.WriteCloser, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if !mr.Compress {
+		return file, nil
+	}
+	gz := gzip.NewWriter(file)
+	return &outputWriter{Writer: gz, closers: closers{gz, file}}, nil
+}
+
+// closers closes a stack of layered readers or writers, outermost first
+type closers []io.Closer
+
+// Close closes every layer, returning the first error
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// inputReader reads an input file through any decompression layers
+type inputReader struct {
+	io.Reader
+	closers
+}
+
+// outputWriter writes a file through any compression layers
+type outputWriter struct {
+	io.Writer
+	closers
+}
+
+// normalizeKey returns the canonical case-insensitive form of a count key
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+// InputSplit is a byte range of an input file read by one map task. A
+// negative Length means the whole file.
+type InputSplit struct {
+	Filename string
+	Offset   int64
+	Length   int64
+	// StartLine is the number of lines in the file before Offset, so that
+	// errors can report file line numbers
+	StartLine int
+}
+
+// SplitFile divides filename into ranges of roughly splitSize bytes. Each
+// range is extended to the end of the line it would otherwise cut, so every
+// line belongs to exactly one split. Gzip files cannot be split and are
+// returned whole.
+func SplitFile(filename string, splitSize int64) ([]InputSplit, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	br := bufio.NewReader(file)
+	if magic, _ := br.Peek(2); splitSize <= 0 || size <= splitSize || (len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+		return []InputSplit{{Filename: filename, Length: -1}}, nil
+	}
+
+	var splits []InputSplit
+	lines := 0
+	for start := int64(0); start < size; {
+		end := start + splitSize
+		if end >= size {
+			end = size
+		} else {
+			if _, err := file.Seek(end, io.SeekStart); err != nil {
+				return nil, err
+			}
+			br.Reset(file)
+			rest, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			end += int64(len(rest))
+		}
+		splits = append(splits, InputSplit{Filename: filename, Offset: start, Length: end - start, StartLine: lines})
+		n, err := countLines(io.NewSectionReader(file, start, end-start))
+		if err != nil {
+			return nil, err
+		}
+		lines += n
+		start = end
+	}
+	return splits, nil
+}
+
+// countLines returns the number of newlines read from r
+func countLines(r io.Reader) (int, error) {
+	buf := make([]byte, 32*1024)
+	n := 0
+	for {
+		read, err := r.Read(buf)
+		n += bytes.Count(buf[:read], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// SplitInputs replaces mr.Files with one entry per split of at most
+// SplitSize bytes and records the byte ranges in mr.Splits
+func SplitInputs(mr *MapReduce) error {
+	var files []string
+	var splits []InputSplit
+	for _, filename := range mr.Files {
+		fileSplits, err := SplitFile(filename, mr.SplitSize)
+		if err != nil {
+			return err
+		}
+		for range fileSplits {
+			files = append(files, filename)
+		}
+		splits = append(splits, fileSplits...)
+	}
+	mr.Files = files
+	mr.Splits = splits
+	mr.NMap = len(splits)
+	return nil
+}
+
+// openTaskInput opens the input of a map task: its InputReader if set, or
+// else its file, limited to the task's byte range when splits are planned
+func openTaskInput(mr *MapReduce, filename string, task int) (io.ReadCloser, error) {
+	if task < len(mr.InputReaders) {
+		return ioutil.NopCloser(mr.countBytes(filename, mr.InputReaders[task], -1)), nil
+	}
+	if task >= len(mr.Splits) || mr.Splits[task].Length < 0 {
+		if mr.OnBytesProgress == nil {
+			return openInput(filename)
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return newInputReader(filename, mr.countBytes(filename, file, info.Size()), file)
+	}
+	split := mr.Splits[task]
+	file, err := os.Open(split.Filename)
+	if err != nil {
+		return nil, err
+	}
+	r := mr.countBytes(filename, io.NewSectionReader(file, split.Offset, split.Length), split.Length)
+	return &inputReader{Reader: r, closers: closers{file}}, nil
+}
+
+// progressInterval is how many bytes a map task reads between calls to
+// OnBytesProgress
+const progressInterval = 1 << 20
+
+// countBytes returns r, reporting the bytes read from it to
+// OnBytesProgress if set
+func (mr *MapReduce) countBytes(filename string, r io.Reader, size int64) io.Reader {
+	if mr.OnBytesProgress == nil {
+		return r
+	}
+	return &progressReader{r: r, report: func(read int64) { mr.OnBytesProgress(filename, read, size) }}
+}
+
+// progressReader counts the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	reported int64
+	done     bool
+	report   func(read int64)
+}
+
+// Read implements io.Reader
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == io.EOF && !p.done {
+		p.done = true
+		p.report(p.read)
+	} else if p.read-p.reported >= progressInterval {
+		p.reported = p.read
+		p.report(p.read)
+	}
+	return n, err
+}
+
+// ParseError locates a record that failed to parse or validate
+type ParseError struct {
+	File string
+	// Line is the 1-based line number within File
+	Line int
+	Err  error
+}
+
+// Error formats the error as "file:line: message"
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying parse or validation error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// IOError reports a failure reading or decoding a file written or read by
+// a run. Errors from opening or creating files are *fs.PathError.
+type IOError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+// Error formats the error as "op path: message"
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// TaskError reports the map or reduce task that failed
+type TaskError struct {
+	// Phase is "map" or "reduce"
+	Phase string
+	Task  int
+	Err   error
+}
+
+// Error formats the error as "phase task N: message"
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s task %d: %v", e.Phase, e.Task, e.Err)
+}
+
+// Unwrap returns the error the task failed with
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// taskError wraps err in a TaskError unless it is nil or already one
+func taskError(phase string, task int, err error) error {
+	var te *TaskError
+	if err == nil || errors.As(err, &te) {
+		return err
+	}
+	return &TaskError{Phase: phase, Task: task, Err: err}
+}
+
+// taskPanicError converts a value recovered from a panicking task into an
+// error
+func taskPanicError(phase string, task int, r any) error {
+	return &TaskError{Phase: phase, Task: task, Err: fmt.Errorf("panicked: %v", r)}
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark
+const utf8BOM = "\uFEFF"
+
+// MapTask function. A panic, such as one in Parser or Filter, is sent to
+// results as an error.
+func MapTask(ctx context.Context, filename string, task int, mr *MapReduce, parser RecordParser, wg *sync.WaitGroup, results chan<- MapResult) {
+	defer wg.Done()
+	var stats RecordStats
+	defer func() {
+		if r := recover(); r != nil {
+			results <- MapResult{RecordStats: stats, Err: taskPanicError("map", task, r)}
+		}
+	}()
+	counts := mr.newCounts()
+	missing := mr.missingValues()
+	categories := mr.treatmentCategories()
+	normalize := mr.normalizeFields()
+	file, err := openTaskInput(mr, filename, task)
+	if err != nil {
+		results <- MapResult{RecordStats: stats, Err: err}
+		return
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	spills := 0
+	scanner := mr.newScanner(file)
+	lineNum := 0
+	if task < len(mr.Splits) {
+		lineNum = mr.Splits[task].StartLine
+	}
+	var rejects bytes.Buffer
+	reject := func(err error) {
+		mr.skipRecord(filename, lineNum, err)
+		stats.Skipped++
+		if mr.WriteRejects {
+			fmt.Fprintf(&rejects, "%v\t%s\n", &ParseError{File: filename, Line: lineNum, Err: err}, scanner.Text())
+		}
+	}
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			results <- MapResult{RecordStats: stats, Err: err}
+			return
+		}
+		lineNum++
+		if mr.SkipHeader && lineNum == 1 {
+			continue
+		}
+		stats.Read++
+		line := scanner.Text()
+		if lineNum == 1 {
+			// Drop the byte order mark some Windows tools write
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
+		ehr, err := parser.Parse(line)
+		if err != nil {
+			// Skip malformed lines such as blanks and header rows
+			reject(err)
+			continue
+		}
+		normalizeRecord(&ehr, normalize)
+		if missing[ehr.Diagnosis] || missing[ehr.Treatment] {
+			if mr.ExcludeMissing {
+				continue
+			}
+			if missing[ehr.Diagnosis] {
+				ehr.Diagnosis = unknownValue
+			}
+			if missing[ehr.Treatment] {
+				ehr.Treatment = unknownValue
+			}
+		}
+		if categories != nil && ehr.Treatment != unknownValue {
+			if category, ok := categories[ehr.Treatment]; ok {
+				ehr.Treatment = category
+			} else if mr.UnmappedTreatment != "" {
+				ehr.Treatment = mr.UnmappedTreatment
+			}
+		}
+		if mr.ValidateAge {
+			if _, err := ParseAge(ehr.Age); err != nil {
+				reject(err)
+				continue
+			}
+		}
+		if mr.PatientIDPattern != nil && !mr.PatientIDPattern.MatchString(ehr.PatientID) {
+			reject(fmt.Errorf("invalid patient ID %q", ehr.PatientID))
+			continue
+		}
+		if mr.Filter != nil && !mr.Filter(ehr) {
+			continue
+		}
+		if mr.IDConflicts {
+			counts["idrecords"][ehr.PatientID+"|"+ehr.Name+"|"+ehr.Age+"|"+ehr.Diagnosis]++
+		}
+		if mr.Dedup {
+			key := ehr.PatientID
+			if mr.DedupByDiagnosis {
+				key += "|" + ehr.Diagnosis
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		stats.Counted++
+		for _, field := range mr.groupByFields() {
+			if _, ok := ehr.Extra[field]; !ok && ehrFields[field] == nil {
+				// The record omits this optional field
+				continue
+			}
+			counts[fieldKind(field)][fieldValue(ehr, field)]++
+		}
+		if mr.GroupByAge {
+			counts["agebracket"][mr.ageBracket(ehr.Age)+"|"+ehr.Diagnosis]++
+		}
+		if mr.CrossTab {
+			counts["crosstab"][ehr.Diagnosis+"|"+ehr.Treatment]++
+		}
+		if mr.NameCollisions {
+			counts["nameids"][ehr.Name+"|"+ehr.PatientID]++
+		}
+		if mr.CountBySource {
+			counts["source"][filename]++
+		}
+		if mr.AgeStats {
+			if age, err := ParseAge(ehr.Age); err == nil {
+				counts["agestats"][ehr.Diagnosis+"|"+strconv.Itoa(age)]++
+			}
+		}
+
+		if mr.CombinerThreshold > 0 && counts.size() > mr.CombinerThreshold {
+			if err := spillCounts(mr, filename, task, spills, counts); err != nil {
+				results <- MapResult{RecordStats: stats, Err: err}
+				return
+			}
+			spills++
+			counts = mr.newCounts()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		results <- MapResult{RecordStats: stats, Err: &IOError{Op: "read", Path: filename, Err: err}}
+		return
+	}
+
+	if spills > 0 {
+		if err := mergeSpills(mr, filename, task, spills, counts); err != nil {
+			results <- MapResult{RecordStats: stats, Err: err}
+			return
+		}
+	}
+
+	for _, kind := range mr.kinds() {
+		if err := writeIntermediate(mr, kind, filename, task, counts[kind]); err != nil {
+			results <- MapResult{RecordStats: stats, Err: err}
+			return
+		}
+	}
+	if mr.WriteRejects {
+		if err := writeRejects(mr, filename, task, rejects.Bytes()); err != nil {
+			results <- MapResult{RecordStats: stats, Err: err}
+			return
+		}
+	}
+
+	results <- MapResult{RecordStats: stats}
+}
+
+// writeRejects writes a map task's rejected records to its rejects file
+func writeRejects(mr *MapReduce, filename string, task int, rejects []byte) error {
+	file, err := createOutput(mr, intermediateName(mr, "rejects", filename, task, 0))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(rejects); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rejectsName returns the path of the file collecting rejected records
+func rejectsName(mr *MapReduce) string {
+	return filepath.Join(mr.OutputDir, "rejects"+runSuffix(mr)+".txt"+compressExt(mr))
+}
+
+// mergeRejects concatenates the map tasks' rejects files, in task order,
+// into the file named by rejectsName
+func mergeRejects(mr *MapReduce) error {
+	output, err := createOutput(mr, rejectsName(mr))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < mr.NMap; i++ {
+		input, err := openInput(intermediateName(mr, "rejects", mr.Files[i], i, 0))
+		if err != nil {
+			output.Close()
+			return err
+		}
+		_, err = io.Copy(output, input)
+		input.Close()
+		if err != nil {
+			output.Close()
+			return err
+		}
+	}
+	return output.Close()
+}
+
+// ReduceTask function
+func ReduceTask(ctx context.Context, task int, mr *MapReduce, wg *sync.WaitGroup, results chan<- error) {
+	defer wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			results <- taskPanicError("reduce", task, r)
+		}
+	}()
+	if mr.streamsReduceOutput() {
+		results <- streamReduceOutput(ctx, mr, task)
+		return
+	}
+	counts, err := reducePartition(ctx, task, mr)
+	if err == nil {
+		err = writeReduceOutput(mr, task, counts)
+	}
+	results <- err
+}
+
+// reducePartition sums a reduce partition's counts across all map tasks'
+// intermediate files, combining them first when CombinerFanIn is set
+func reducePartition(ctx context.Context, task int, mr *MapReduce) (kindCounts, error) {
+	if err := combinePartition(ctx, mr, task); err != nil {
+		return nil, err
+	}
+
+	counts := mr.newCounts()
+	for _, kind := range mr.kinds() {
+		inputs, _ := combineTree(mr, kind, task, nil)
+		for _, name := range inputs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := mr.readIntermediate(name, counts[kind]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return counts, nil
+}
+
+// readIntermediate reads an intermediate file's counts into counts. With
+// SkipMissingIntermediate a missing file is treated as empty.
+func (mr *MapReduce) readIntermediate(name string, counts map[string]int) error {
+	file, err := mr.openIntermediate(name)
+	if err != nil || file == nil {
+		return err
+	}
+	defer file.Close()
+	return sumCounts(mr, name, file, counts)
+}
+
+// openIntermediate opens an intermediate file, first verifying its
+// checksum if Checksums is set. With SkipMissingIntermediate a missing file
+// is reported and a nil reader returned; a missing checksum sidecar for a
+// file that exists is still an error.
+func (mr *MapReduce) openIntermediate(name string) (io.ReadCloser, error) {
+	if _, err := os.Stat(name); err != nil {
+		if mr.SkipMissingIntermediate && errors.Is(err, os.ErrNotExist) {
+			if mr.Logger != nil {
+				mr.Logger.Warn("missing intermediate file skipped", "file", name)
+			} else {
+				log.Printf("skipping missing intermediate file %s", name)
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+	if mr.Checksums {
+		if err := verifyChecksum(name); err != nil {
+			return nil, err
+		}
+	}
+	return openInput(name)
+}
+
+// IntermediateFile is the parsed content of one map task's intermediate
+// file
+type IntermediateFile struct {
+	Name      string
+	Kind      string
+	Task      int
+	Partition int
+	Counts    map[string]int
+}
+
+// Intermediates reads the intermediate files the map tasks wrote for a
+// reduce partition, in task and kind order, without reducing them. It lets
+// the shuffle be inspected after the map phase, or after Run when
+// KeepIntermediate is set.
+func (mr *MapReduce) Intermediates(partition int) ([]IntermediateFile, error) {
+	if partition < 0 || partition >= mr.NReduce {
+		return nil, fmt.Errorf("invalid reduce partition %d", partition)
+	}
+	var files []IntermediateFile
+	for task := 0; task < mr.NMap; task++ {
+		for _, kind := range mr.kinds() {
+			file := IntermediateFile{
+				Name:      intermediateName(mr, kind, mr.Files[task], task, partition),
+				Kind:      kind,
+				Task:      task,
+				Partition: partition,
+				Counts:    make(map[string]int),
+			}
+			if err := mr.readIntermediate(file.Name, file.Counts); err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// readCounts adds the counts of the named intermediate file to counts
+func readCounts(mr *MapReduce, name string, counts map[string]int) error {
+	file, err := openInput(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sumCounts(mr, name, file, counts)
+}
+
+// sumCounts adds the pairs read from r, the contents of the count file
+// name, into counts
+func sumCounts(mr *MapReduce, name string, r io.Reader, counts map[string]int) error {
+	reader := newCountReader(mr, r)
+	for {
+		key, count, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &IOError{Op: "read", Path: name, Err: err}
+		}
+		counts[key] += count
+	}
+}
+
+// countWriter writes key and count pairs in mr's IntermediateFormat
+type countWriter struct {
+	*bufio.Writer
+	mr  *MapReduce
+	enc *gob.Encoder
+}
+
+// newCountWriter returns a buffered countWriter writing to w. Errors are
+// reported by Flush.
+func newCountWriter(mr *MapReduce, w io.Writer) *countWriter {
+	cw := &countWriter{Writer: bufio.NewWriter(w), mr: mr}
+	if mr.IntermediateFormat == "gob" {
+		cw.enc = gob.NewEncoder(cw.Writer)
+	}
+	return cw
+}
+
+// write writes one pair
+func (cw *countWriter) write(key string, count int) {
+	if cw.enc != nil {
+		cw.enc.Encode(KeyCount{Key: key, Count: count})
+		return
+	}
+	writeCountLine(cw.mr, cw.Writer, key, count)
+}
+
+// countReader reads the pairs written by a countWriter
+type countReader struct {
+	scanner *bufio.Scanner
+	dec     *gob.Decoder
+	sep     string
+}
+
+// newCountReader returns a countReader for r in mr's IntermediateFormat
+func newCountReader(mr *MapReduce, r io.Reader) *countReader {
+	if mr.IntermediateFormat == "gob" {
+		return &countReader{dec: gob.NewDecoder(r)}
+	}
+	return &countReader{scanner: mr.newScanner(r), sep: mr.fieldSep()}
+}
+
+// next returns the following pair, or io.EOF at the end of the input
+func (cr *countReader) next() (string, int, error) {
+	if cr.dec != nil {
+		var kc KeyCount
+		if err := cr.dec.Decode(&kc); err != nil {
+			return "", 0, err
+		}
+		return kc.Key, kc.Count, nil
+	}
+	if !cr.scanner.Scan() {
+		if err := cr.scanner.Err(); err != nil {
+			return "", 0, err
+		}
+		return "", 0, io.EOF
+	}
+	return parseCountLine(cr.scanner.Text(), cr.sep)
+}
+
+// writeCountLine writes key and count as an intermediate line separated by
+// mr.fieldSep(). The key is written as a Go quoted string so that the
+// separator, newlines and other characters in keys cannot be confused with
+// the delimiter.
+func writeCountLine(mr *MapReduce, w io.Writer, key string, count int) {
+	fmt.Fprintf(w, "%s%s%d\n", strconv.Quote(key), mr.fieldSep(), count)
+}
+
+// parseCountLine parses a line written by writeCountLine with separator sep
+func parseCountLine(line string, sep string) (string, int, error) {
+	quoted, err := strconv.QuotedPrefix(line)
+	if err != nil || !strings.HasPrefix(line[len(quoted):], sep) {
+		return "", 0, fmt.Errorf("malformed count line %q", line)
+	}
+	key, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed count line %q", line)
+	}
+	count, err := strconv.Atoi(line[len(quoted)+len(sep):])
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed count line %q", line)
+	}
+	return key, count, nil
+}
+
+// writeCounts writes counts to the named file in key order
+func writeCounts(mr *MapReduce, name string, counts map[string]int) error {
+	file, err := createOutput(mr, name)
+	if err != nil {
+		return err
+	}
+	w := newCountWriter(mr, file)
+	for _, key := range countKeys(counts) {
+		w.write(key, counts[key])
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if mr.Checksums {
+		return writeChecksum(name)
+	}
+	return nil
+}
+
+// countKeys returns the keys of counts in ascending order
+func countKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeBufferBytes is the memory assumed per file open in a k-way merge
+const mergeBufferBytes = bufio.MaxScanTokenSize
+
+// combinerFanIn returns CombinerFanIn, or when only MaxReduceMemory is set
+// the number of files whose merge buffers fit in it
+func (mr *MapReduce) combinerFanIn() int {
+	if mr.CombinerFanIn > 1 || mr.MaxReduceMemory <= 0 {
+		return mr.CombinerFanIn
+	}
+	return max(2, mr.MaxReduceMemory/mergeBufferBytes)
+}
+
+// sortedStream is one key-sorted input to mergeByKey
+type sortedStream interface {
+	// peek returns the key of the current pair, or false at the end
+	peek() (string, bool)
+}
+
+// mergeByKey merges streams in key order. For each key it calls take once
+// per pair of that key, in stream order, and take must advance the stream
+// it is given; it then calls emit with the key. Only the current pair of
+// each stream is held in memory.
+func mergeByKey[S sortedStream](ctx context.Context, streams []S, take func(s S) error, emit func(key string) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var key string
+		found := false
+		for _, s := range streams {
+			if k, ok := s.peek(); ok && (!found || k < key) {
+				key, found = k, true
+			}
+		}
+		if !found {
+			return nil
+		}
+		for _, s := range streams {
+			for k, ok := s.peek(); ok && k == key; k, ok = s.peek() {
+				if err := take(s); err != nil {
+					return err
+				}
+			}
+		}
+		if err := emit(key); err != nil {
+			return err
+		}
+	}
+}
+
+// countStream reads the pairs of one key-sorted file in order
+type countStream struct {
+	name   string
+	file   io.ReadCloser
+	reader *countReader
+	key    string
+	count  int
+	ok     bool
+}
+
+// next advances to the following pair, clearing ok at the end of the file
+func (s *countStream) next() error {
+	key, count, err := s.reader.next()
+	if err == io.EOF {
+		s.ok = false
+		return nil
+	}
+	s.key, s.count, s.ok = key, count, err == nil
+	return err
+}
+
+// peek returns the key of the current pair
+func (s *countStream) peek() (string, bool) {
+	return s.key, s.ok
+}
+
+// openCountStreams opens the key-sorted count files inputs positioned on
+// their first pairs, skipping missing files as openIntermediate does. The
+// caller closes the streams, even on error.
+func openCountStreams(mr *MapReduce, inputs []string) ([]*countStream, error) {
+	streams := make([]*countStream, 0, len(inputs))
+	for _, name := range inputs {
+		file, err := mr.openIntermediate(name)
+		if err != nil {
+			return streams, err
+		}
+		if file == nil {
+			continue
+		}
+		s := &countStream{name: name, file: file, reader: newCountReader(mr, file)}
+		streams = append(streams, s)
+		if err := s.next(); err != nil {
+			return streams, &IOError{Op: "read", Path: name, Err: err}
+		}
+	}
+	return streams, nil
+}
+
+// closeCountStreams closes the files of streams
+func closeCountStreams(streams []*countStream) {
+	for _, s := range streams {
+		s.file.Close()
+	}
+}
+
+// sumByKey calls emit with each key of streams in key order and the sum of
+// its counts across them
+func sumByKey(ctx context.Context, streams []*countStream, emit func(key string, count int) error) error {
+	count := 0
+	return mergeByKey(ctx, streams, func(s *countStream) error {
+		count += s.count
+		if err := s.next(); err != nil {
+			return &IOError{Op: "read", Path: s.name, Err: err}
+		}
+		return nil
+	}, func(key string) error {
+		total := count
+		count = 0
+		return emit(key, total)
+	})
+}
+
+// mergeSortedCounts writes the sum of the key-sorted count files inputs to
+// output, holding one line per input in memory
+func mergeSortedCounts(ctx context.Context, mr *MapReduce, inputs []string, output string) error {
+	streams, err := openCountStreams(mr, inputs)
+	defer closeCountStreams(streams)
+	if err != nil {
+		return err
+	}
+
+	file, err := createOutput(mr, output)
+	if err != nil {
+		return err
+	}
+	w := newCountWriter(mr, file)
+	err = sumByKey(ctx, streams, func(key string, count int) error {
+		w.write(key, count)
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if mr.Checksums {
+		return writeChecksum(output)
+	}
+	return nil
+}
+
+// combineName returns the path of a combined file at one level of a
+// partition's combiner tree
+func combineName(mr *MapReduce, kind string, level, index, partition int) string {
+	return filepath.Join(mr.intermediateDir(), fmt.Sprintf("combine-%s-%d-%d-%d.%s%s", kind, level, index, partition, intermediateExt(mr, kind), compressExt(mr)))
+}
+
+// combineTree walks the combiner tree for a partition's intermediate files
+// of one kind. Each level merges groups of CombinerFanIn files into one
+// until at most CombinerFanIn remain; fn, if set, is called for every
+// merge. It returns the files left for the reducer to read.
+func combineTree(mr *MapReduce, kind string, partition int, fn func(inputs []string, output string) error) ([]string, error) {
+	names := make([]string, mr.NMap)
+	for i := range names {
+		names[i] = intermediateName(mr, kind, mr.Files[i], i, partition)
+	}
+	fanIn := mr.combinerFanIn()
+	for level := 0; fanIn > 1 && len(names) > fanIn; level++ {
+		var next []string
+		for i := 0; i < len(names); i += fanIn {
+			end := i + fanIn
+			if end > len(names) {
+				end = len(names)
+			}
+			output := combineName(mr, kind, level, i/fanIn, partition)
+			if fn != nil {
+				if err := fn(names[i:end], output); err != nil {
+					return nil, err
+				}
+			}
+			next = append(next, output)
+		}
+		names = next
+	}
+	return names, nil
+}
+
+// combinePartition merges a partition's intermediate files through the
+// combiner tree so the reducer reads at most CombinerFanIn files per kind
+func combinePartition(ctx context.Context, mr *MapReduce, partition int) error {
+	if mr.combinerFanIn() <= 1 {
+		return nil
+	}
+	for _, kind := range mr.kinds() {
+		_, err := combineTree(mr, kind, partition, func(inputs []string, output string) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if mr.MaxReduceMemory > 0 {
+				return mergeSortedCounts(ctx, mr, inputs, output)
+			}
+			counts := make(map[string]int)
+			for _, name := range inputs {
+				if err := mr.readIntermediate(name, counts); err != nil {
+					return err
+				}
+			}
+			return writeCounts(mr, output, counts)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamsReduceOutput reports whether reduce tasks write their outputs
+// straight from a k-way merge of the combined files rather than from
+// partition-wide counts: MaxReduceMemory is set, every output is text or
+// CSV in key order, and every kind is a plain count
+func (mr *MapReduce) streamsReduceOutput() bool {
+	if mr.MaxReduceMemory <= 0 || mr.TopN > 0 || (mr.SortBy != "" && mr.SortBy != "key") {
+		return false
+	}
+	if mr.GroupByAge || mr.CrossTab || mr.NameCollisions || mr.IDConflicts || mr.AgeStats {
+		return false
+	}
+	for _, format := range mr.outputFormats() {
+		if format != "text" && format != "csv" {
+			return false
+		}
+	}
+	return true
+}
+
+// streamReduceOutput combines a reduce partition's intermediate files and
+// writes its outputs from a k-way merge of what the combiner leaves,
+// holding one pair per file in memory. Only jobs for which
+// streamsReduceOutput holds may use it.
+func streamReduceOutput(ctx context.Context, mr *MapReduce, task int) error {
+	if err := combinePartition(ctx, mr, task); err != nil {
+		return err
+	}
+	for _, format := range mr.outputFormats() {
+		outputName, err := reduceOutputName(mr, task, format)
+		if err != nil {
+			return err
+		}
+		outputFile, err := openOutput(mr, outputName)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(outputFile)
+		if format == "csv" {
+			err = streamCSVOutput(ctx, w, mr, task)
+		} else {
+			err = streamTextOutput(ctx, w, mr, task)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := outputFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamKind calls emit in key order with each key of kind in the reduce
+// partition task and its count, skipping counts below MinCount
+func streamKind(ctx context.Context, mr *MapReduce, kind string, task int, emit func(key string, count int) error) error {
+	inputs, _ := combineTree(mr, kind, task, nil)
+	streams, err := openCountStreams(mr, inputs)
+	defer closeCountStreams(streams)
+	if err != nil {
+		return err
+	}
+	return sumByKey(ctx, streams, func(key string, count int) error {
+		if count < mr.MinCount {
+			return nil
+		}
+		return emit(key, count)
+	})
+}
+
+// streamTextOutput writes the text output of the reduce partition task to
+// w as writeTextOutput does
+func streamTextOutput(ctx context.Context, w io.Writer, mr *MapReduce, task int) error {
+	writeLine := func(key string, count int) error {
+		_, err := fmt.Fprintf(w, "%v%s%v\n", key, mr.fieldSep(), count)
+		return err
+	}
+	for _, field := range mr.groupByFields() {
+		fmt.Fprintf(w, "%s Counts:\n", field)
+		if err := streamKind(ctx, mr, fieldKind(field), task, writeLine); err != nil {
+			return err
+		}
+	}
+	if mr.CountBySource {
+		fmt.Fprintln(w, "Record Counts by Source File:")
+		return streamKind(ctx, mr, "source", task, writeLine)
+	}
+	return nil
+}
+
+// streamCSVOutput writes the CSV output of the reduce partition task to w
+// as writeCSVOutput does
+func streamCSVOutput(ctx context.Context, w io.Writer, mr *MapReduce, task int) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"category", "key", "count"})
+	writeRow := func(category string) func(key string, count int) error {
+		return func(key string, count int) error {
+			return cw.Write([]string{category, key, strconv.Itoa(count)})
+		}
+	}
+	for _, field := range mr.groupByFields() {
+		kind := fieldKind(field)
+		if err := streamKind(ctx, mr, kind, task, writeRow(kind)); err != nil {
+			return err
+		}
+	}
+	if mr.CountBySource {
+		if err := streamKind(ctx, mr, "source", task, writeRow("source")); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeReduceOutput writes a reduce partition's counts in each output format
+func writeReduceOutput(mr *MapReduce, task int, counts kindCounts) error {
+	for _, format := range mr.outputFormats() {
+		outputName, err := reduceOutputName(mr, task, format)
+		if err != nil {
+			return err
+		}
+		if err := writeOutputFile(mr, outputName, format, counts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutputFile writes counts to the named file in format
+func writeOutputFile(mr *MapReduce, outputName string, format string, counts kindCounts) error {
+	if mr.SortBy != "" && mr.SortBy != "key" && mr.SortBy != "count" {
+		return fmt.Errorf("unknown sort order %q", mr.SortBy)
+	}
+
+	outputFile, err := openOutput(mr, outputName)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		err = writeJSONOutput(outputFile, mr, counts)
+	case "csv":
+		err = writeCSVOutput(outputFile, mr, counts)
+	default:
+		err = writeTextOutput(outputFile, mr, counts)
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openOutput opens the named reduce output through OutputSink if set, or
+// else creates the file
+func openOutput(mr *MapReduce, name string) (io.WriteCloser, error) {
+	if mr.OutputSink != nil {
+		return mr.OutputSink(name)
+	}
+	return createOutput(mr, name)
+}
+
+// WriterSink returns an OutputSink that writes every reduce output to w.
+// Each output is buffered and written in one piece when closed, so that
+// concurrent reduce tasks do not interleave.
+func WriterSink(w io.Writer) func(name string) (io.WriteCloser, error) {
+	var mu sync.Mutex
+	return func(name string) (io.WriteCloser, error) {
+		return &sinkWriter{w: w, mu: &mu}, nil
+	}
+}
+
+// sinkWriter buffers one reduce output for WriterSink
+type sinkWriter struct {
+	bytes.Buffer
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+// Close writes the buffered output to the underlying writer
+func (s *sinkWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(s.Bytes())
+	return err
+}
+
+// writeTextOutput writes a partition's counts as human-readable sections,
+// returning the first write error
+func writeTextOutput(out io.Writer, mr *MapReduce, counts kindCounts) error {
+	w := bufio.NewWriter(out)
+	for _, field := range mr.groupByFields() {
+		fmt.Fprintf(w, "%s Counts:\n", field)
+		for _, kc := range sortedCounts(mr, counts[fieldKind(field)]) {
+			fmt.Fprintf(w, "%v%s%v\n", kc.Key, mr.fieldSep(), kc.Count)
+		}
+	}
+
+	if mr.GroupByAge {
+		if err := writeAgeCounts(w, mr, counts["agebracket"]); err != nil {
+			return err
+		}
+	}
+	if mr.CrossTab {
+		if err := writeCrossTab(w, mr, counts["crosstab"]); err != nil {
+			return err
+		}
+	}
+	if mr.NameCollisions {
+		collisions := nameCollisions(counts["nameids"])
+		fmt.Fprintln(w, "Names Shared by Multiple Patient IDs:")
+		for _, name := range sortedNames(collisions) {
+			fmt.Fprintf(w, "%v: %v\n", name, strings.Join(collisions[name], " "))
+		}
+	}
+	if mr.IDConflicts {
+		conflicts := idConflicts(counts["idrecords"])
+		fmt.Fprintln(w, "Patient IDs with Conflicting Records:")
+		for _, id := range sortedConflicts(conflicts) {
+			variants := make([]string, len(conflicts[id]))
+			for i, v := range conflicts[id] {
+				variants[i] = fmt.Sprintf("%s, %s, %s (%d)", v.Name, v.Age, v.Diagnosis, v.Count)
+			}
+			fmt.Fprintf(w, "%v: %v\n", id, strings.Join(variants, "; "))
+		}
+	}
+	if mr.AgeStats {
+		stats := ageSummaries(counts["agestats"])
+		fmt.Fprintln(w, "Age Statistics by Diagnosis:")
+		for _, diagnosis := range sortedSummaries(stats) {
+			fmt.Fprintf(w, "%v: mean %.1f median %g (n=%d)\n", diagnosis, stats[diagnosis].Mean, stats[diagnosis].Median, stats[diagnosis].Count)
+		}
+	}
+	if mr.CountBySource {
+		fmt.Fprintln(w, "Record Counts by Source File:")
+		for _, kc := range sortedCounts(mr, counts["source"]) {
+			fmt.Fprintf(w, "%v%s%v\n", kc.Key, mr.fieldSep(), kc.Count)
+		}
+	}
+	return w.Flush()
+}
+
+// nameCollisions returns the sorted PatientIDs of each name seen with more
+// than one, from counts keyed by "name|patientID"
+func nameCollisions(counts map[string]int) map[string][]string {
+	ids := make(map[string][]string)
+	for key := range counts {
+		i := strings.LastIndexByte(key, '|')
+		ids[key[:i]] = append(ids[key[:i]], key[i+1:])
+	}
+	collisions := make(map[string][]string)
+	for name, nameIDs := range ids {
+		if len(nameIDs) > 1 {
+			sort.Strings(nameIDs)
+			collisions[name] = nameIDs
+		}
+	}
+	return collisions
+}
+
+// RecordVariant is one version of a patient's record and the number of
+// times it was seen
+type RecordVariant struct {
+	Name      string `json:"name"`
+	Age       string `json:"age"`
+	Diagnosis string `json:"diagnosis"`
+	Count     int    `json:"count"`
+}
+
+// idConflicts returns the sorted record variants of each PatientID seen
+// with more than one, from counts keyed by "patientID|name|age|diagnosis"
+func idConflicts(counts map[string]int) map[string][]RecordVariant {
+	variants := make(map[string][]RecordVariant)
+	for key, count := range counts {
+		id, rest, _ := strings.Cut(key, "|")
+		i := strings.LastIndexByte(rest, '|')
+		diagnosis := rest[i+1:]
+		rest = rest[:i]
+		i = strings.LastIndexByte(rest, '|')
+		variants[id] = append(variants[id], RecordVariant{Name: rest[:i], Age: rest[i+1:], Diagnosis: diagnosis, Count: count})
+	}
+	conflicts := make(map[string][]RecordVariant)
+	for id, idVariants := range variants {
+		if len(idVariants) > 1 {
+			sort.Slice(idVariants, func(i, j int) bool {
+				a, b := idVariants[i], idVariants[j]
+				if a.Name != b.Name {
+					return a.Name < b.Name
+				}
+				if a.Age != b.Age {
+					return a.Age < b.Age
+				}
+				return a.Diagnosis < b.Diagnosis
+			})
+			conflicts[id] = idVariants
+		}
+	}
+	return conflicts
+}
+
+// sortedConflicts returns the PatientIDs in conflicts in alphabetical order
+func sortedConflicts(conflicts map[string][]RecordVariant) []string {
+	ids := make([]string, 0, len(conflicts))
+	for id := range conflicts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sortedNames returns the names in collisions in alphabetical order
+func sortedNames(collisions map[string][]string) []string {
+	names := make([]string, 0, len(collisions))
+	for name := range collisions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reduceOutputName returns the path a reduce task writes its output in
+// format to
+func reduceOutputName(mr *MapReduce, task int, format string) (string, error) {
+	ext, err := outputExt(mr, format)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mr.OutputDir, fmt.Sprintf("reduce-out%s-%d.%s", runSuffix(mr), task, ext)), nil
+}
+
+// mergedOutputName returns the path of the single output file in format
+// written when MergeOutput is set
+func mergedOutputName(mr *MapReduce, format string) (string, error) {
+	ext, err := outputExt(mr, format)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mr.OutputDir, "reduce-out"+runSuffix(mr)+"."+ext), nil
+}
+
+// runSuffix returns the part of output names identifying the run, if any
+func runSuffix(mr *MapReduce) string {
+	if mr.RunID == "" {
+		return ""
+	}
+	return "-" + mr.RunID
+}
+
+// NewRunID returns a RunID for the current time, such as "20240101-120000"
+func NewRunID() string {
+	return time.Now().Format("20060102-150405")
+}
+
+// outputExt returns the extension of reduce output files for format and
+// mr's compression
+func outputExt(mr *MapReduce, format string) (string, error) {
+	ext, ok := outputExtensions[format]
+	if !ok {
+		return "", fmt.Errorf("unknown output format %q", format)
+	}
+	return ext + compressExt(mr), nil
+}
+
+// outputExtensions maps each supported OutputFormat to its file extension
+var outputExtensions = map[string]string{
+	"text": "txt",
+	"json": "json",
+	"csv":  "csv",
+}
+
+// MergeOutputs sums the counts of reduce output files, in text or JSON form
+// and possibly from separate runs, and writes them to out in the format of
+// its extension. Age statistics cannot be merged, nor ID conflicts from
+// text output, since their underlying counts are not kept.
+func MergeOutputs(paths []string, out string) error {
+	merged := &mergedOutput{counts: make(kindCounts)}
+	for _, path := range paths {
+		var err error
+		if outputFormatOf(path) == "json" {
+			err = merged.readJSON(path)
+		} else {
+			err = merged.readText(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	mr := &MapReduce{
+		GroupByFields:  merged.fields,
+		GroupByAge:     len(merged.counts["agebracket"]) > 0,
+		CrossTab:       len(merged.counts["crosstab"]) > 0,
+		NameCollisions: len(merged.counts["nameids"]) > 0,
+		IDConflicts:    len(merged.counts["idrecords"]) > 0,
+		CountBySource:  len(merged.counts["source"]) > 0,
+		Compress:       strings.HasSuffix(out, ".gz"),
+	}
+	for _, label := range merged.labels {
+		if !containsLabel(DefaultAgeBrackets, label) {
+			// Keep custom brackets in the order they were read
+			for _, label := range merged.labels {
+				mr.AgeBrackets = append(mr.AgeBrackets, AgeBracket{Label: label})
+			}
+			break
+		}
+	}
+	return writeOutputFile(mr, out, outputFormatOf(out), merged.counts)
+}
+
+// outputFormatOf returns the output format named by a file's extension
+func outputFormatOf(name string) string {
+	name = strings.TrimSuffix(name, ".gz")
+	for format, ext := range outputExtensions {
+		if strings.HasSuffix(name, "."+ext) {
+			return format
+		}
+	}
+	return "text"
+}
+
+// containsLabel reports whether brackets include one labelled label
+func containsLabel(brackets []AgeBracket, label string) bool {
+	for _, bracket := range brackets {
+		if bracket.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedOutput accumulates the counts of reduce outputs read by
+// MergeOutputs
+type mergedOutput struct {
+	counts kindCounts
+	// fields and labels are the count fields and custom age brackets, in
+	// the order first read
+	fields []string
+	labels []string
+}
+
+// add adds count to key of kind
+func (m *mergedOutput) add(kind, key string, count int) {
+	if m.counts[kind] == nil {
+		m.counts[kind] = make(map[string]int)
+	}
+	m.counts[kind][key] += count
+}
+
+// addField records that field is counted
+func (m *mergedOutput) addField(field string) {
+	for _, f := range m.fields {
+		if f == field {
+			return
+		}
+	}
+	m.fields = append(m.fields, field)
+}
+
+// addLabel records an age bracket label, other than the unknown bracket
+func (m *mergedOutput) addLabel(label string) {
+	if label == unknownAgeBracket {
+		return
+	}
+	for _, l := range m.labels {
+		if l == label {
+			return
+		}
+	}
+	m.labels = append(m.labels, label)
+}
+
+// readJSON adds the counts of a JSON reduce output
+func (m *mergedOutput) readJSON(path string) error {
+	file, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var out ReduceOutput
+	if err := json.NewDecoder(file).Decode(&out); err != nil {
+		return &IOError{Op: "decode", Path: path, Err: err}
+	}
+	if len(out.AgeStats) > 0 {
+		return fmt.Errorf("%s: age statistics cannot be merged", path)
+	}
+
+	fields := map[string]map[string]int{"Diagnosis": out.Diagnosis, "Treatment": out.Treatment}
+	for kind, counts := range out.Fields {
+		fields[kind] = counts
+	}
+	for _, field := range []string{"Diagnosis", "Treatment"} {
+		if len(fields[field]) > 0 {
+			m.addField(field)
+		}
+	}
+	kinds := make([]string, 0, len(out.Fields))
+	for kind := range out.Fields {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		m.addField(kind)
+	}
+	for field, counts := range fields {
+		for key, count := range counts {
+			m.add(fieldKind(field), key, count)
+		}
+	}
+	for _, label := range sortedKeys(out.AgeBrackets) {
+		m.addLabel(label)
+		for diagnosis, count := range out.AgeBrackets[label] {
+			m.add("agebracket", label+"|"+diagnosis, count)
+		}
+	}
+	for diagnosis, counts := range out.CrossTab {
+		for treatment, count := range counts {
+			m.add("crosstab", diagnosis+"|"+treatment, count)
+		}
+	}
+	for name, ids := range out.NameCollisions {
+		for _, id := range ids {
+			m.add("nameids", name+"|"+id, 1)
+		}
+	}
+	for id, variants := range out.IDConflicts {
+		for _, v := range variants {
+			m.add("idrecords", id+"|"+v.Name+"|"+v.Age+"|"+v.Diagnosis, v.Count)
+		}
+	}
+	for source, count := range out.Sources {
+		m.add("source", source, count)
+	}
+	return nil
+}
+
+// readText adds the counts of a text reduce output written with the
+// default field separator
+func (m *mergedOutput) readText(path string) error {
+	file, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// unmerged is the header of a section whose entries cannot be merged
+	var kind, outer, unmerged string
+	nested := false
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			continue
+		case line == "Diagnosis Counts by Age Bracket:":
+			kind, outer, nested = "agebracket", "", true
+			continue
+		case line == "Treatment Counts by Diagnosis:":
+			kind, outer, nested = "crosstab", "", true
+			continue
+		case line == "Names Shared by Multiple Patient IDs:":
+			kind, nested = "nameids", false
+			continue
+		case line == "Record Counts by Source File:":
+			kind, nested = "source", false
+			continue
+		case line == "Patient IDs with Conflicting Records:", line == "Age Statistics by Diagnosis:":
+			kind, nested, unmerged = "", false, line
+			continue
+		case strings.HasSuffix(line, " Counts:"):
+			field := strings.TrimSuffix(line, " Counts:")
+			m.addField(field)
+			kind, nested = fieldKind(field), false
+			continue
+		case kind == "" && unmerged != "":
+			return fmt.Errorf("%s:%d: section %q cannot be merged", path, lineNum, unmerged)
+		case nested && strings.HasSuffix(line, ":"):
+			outer = strings.TrimSuffix(line, ":")
+			if kind == "agebracket" {
+				m.addLabel(outer)
+			}
+			continue
+		case kind == "nameids":
+			i := strings.LastIndex(line, ": ")
+			if i < 0 {
+				return fmt.Errorf("%s:%d: malformed name line %q", path, lineNum, line)
+			}
+			for _, id := range strings.Fields(line[i+2:]) {
+				m.add(kind, line[:i]+"|"+id, 1)
+			}
+			continue
+		}
+
+		i := strings.LastIndexFunc(line, unicode.IsSpace)
+		count, err := strconv.Atoi(line[i+1:])
+		if i < 0 || err != nil || kind == "" || (nested && outer == "") {
+			return fmt.Errorf("%s:%d: malformed count line %q", path, lineNum, line)
+		}
+		key := line[:i]
+		if nested {
+			key = outer + "|" + key
+		}
+		m.add(kind, key, count)
+	}
+	if err := scanner.Err(); err != nil {
+		return &IOError{Op: "read", Path: path, Err: err}
+	}
+	return nil
+}
+
+// KeyCount is an aggregated count for a single key
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// sortedCounts returns counts of at least MinCount ordered according to
+// mr.SortBy. When TopN is set only the N highest counts are returned,
+// ordered by count.
+func sortedCounts(mr *MapReduce, counts map[string]int) []KeyCount {
+	sorted := make([]KeyCount, 0, len(counts))
+	for key, count := range counts {
+		if count >= mr.MinCount {
+			sorted = append(sorted, KeyCount{Key: key, Count: count})
+		}
+	}
+	byCount := mr.SortBy == "count" || mr.TopN > 0
+	sort.Slice(sorted, func(i, j int) bool {
+		if byCount && sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+	if mr.TopN > 0 && len(sorted) > mr.TopN {
+		sorted = sorted[:mr.TopN]
+	}
+	return sorted
+}
+
+// limitCounts returns the subset of counts reported under MinCount and TopN
+func limitCounts(mr *MapReduce, counts map[string]int) map[string]int {
+	if mr.TopN <= 0 && mr.MinCount <= 1 {
+		return counts
+	}
+	limited := make(map[string]int)
+	for _, kc := range sortedCounts(mr, counts) {
+		limited[kc.Key] = kc.Count
+	}
+	return limited
+}
+
+// ReduceOutput is the JSON form of a reduce partition's counts
+type ReduceOutput struct {
+	Diagnosis map[string]int `json:"diagnosis"`
+	Treatment map[string]int `json:"treatment"`
+	// Fields holds counts of GroupByFields other than Diagnosis and
+	// Treatment, keyed by lowercased field name
+	Fields      map[string]map[string]int `json:"fields,omitempty"`
+	AgeBrackets map[string]map[string]int `json:"age_brackets,omitempty"`
+	CrossTab    map[string]map[string]int `json:"cross_tab,omitempty"`
+	// NameCollisions maps each name shared by several patients to their IDs
+	NameCollisions map[string][]string `json:"name_collisions,omitempty"`
+	// IDConflicts maps each PatientID seen with differing records to them
+	IDConflicts map[string][]RecordVariant `json:"id_conflicts,omitempty"`
+	// Sources counts the records taken from each input file
+	Sources map[string]int `json:"sources,omitempty"`
+	// AgeStats summarizes the ages of patients with each diagnosis
+	AgeStats map[string]AgeSummary `json:"age_stats,omitempty"`
+}
+
+// writeJSONOutput writes a partition's counts as a ReduceOutput document
+func writeJSONOutput(w io.Writer, mr *MapReduce, counts kindCounts) error {
+	out := ReduceOutput{
+		Diagnosis: limitCounts(mr, counts["diagnosis"]),
+		Treatment: limitCounts(mr, counts["treatment"]),
+	}
+	for _, field := range mr.groupByFields() {
+		if kind := fieldKind(field); kind != "diagnosis" && kind != "treatment" {
+			if out.Fields == nil {
+				out.Fields = make(map[string]map[string]int)
+			}
+			out.Fields[kind] = limitCounts(mr, counts[kind])
+		}
+	}
+	if mr.GroupByAge {
+		out.AgeBrackets = groupCounts(counts["agebracket"])
+		for bracket, bracketCounts := range out.AgeBrackets {
+			out.AgeBrackets[bracket] = limitCounts(mr, bracketCounts)
+		}
+	}
+	if mr.CrossTab {
+		out.CrossTab = groupCounts(counts["crosstab"])
+		for diagnosis, treatmentCounts := range out.CrossTab {
+			out.CrossTab[diagnosis] = limitCounts(mr, treatmentCounts)
+		}
+	}
+	if mr.NameCollisions {
+		out.NameCollisions = nameCollisions(counts["nameids"])
+	}
+	if mr.IDConflicts {
+		out.IDConflicts = idConflicts(counts["idrecords"])
+	}
+	if mr.CountBySource {
+		out.Sources = counts["source"]
+	}
+	if mr.AgeStats {
+		out.AgeStats = ageSummaries(counts["agestats"])
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// writeCSVOutput writes a partition's counts as category,key,count rows,
+// with each counted field's lowercased name as its category. Age bracket
+// rows use the category "age:<bracket>", cross-tab rows
+// "crosstab:<diagnosis>" keyed by treatment, and name collision rows
+// "collision:<name>" keyed by PatientID with that pair's record count.
+// PatientID conflict rows use "conflict:<patientID>" keyed by
+// "name|age|diagnosis". Per-file record counts use the category "source",
+// and age statistics "agestats:<diagnosis>" keyed by "count", "mean" and
+// "median".
+func writeCSVOutput(w io.Writer, mr *MapReduce, counts kindCounts) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"category", "key", "count"})
+	for _, field := range mr.groupByFields() {
+		kind := fieldKind(field)
+		for _, kc := range sortedCounts(mr, counts[kind]) {
+			cw.Write([]string{kind, kc.Key, strconv.Itoa(kc.Count)})
+		}
+	}
+	if mr.GroupByAge {
+		byBracket := groupCounts(counts["agebracket"])
+		for _, label := range bracketLabels(mr) {
+			for _, kc := range sortedCounts(mr, byBracket[label]) {
+				cw.Write([]string{"age:" + label, kc.Key, strconv.Itoa(kc.Count)})
+			}
+		}
+	}
+	if mr.CrossTab {
+		byDiagnosis := groupCounts(counts["crosstab"])
+		for _, diagnosis := range sortedKeys(byDiagnosis) {
+			for _, kc := range sortedCounts(mr, byDiagnosis[diagnosis]) {
+				cw.Write([]string{"crosstab:" + diagnosis, kc.Key, strconv.Itoa(kc.Count)})
+			}
+		}
+	}
+	if mr.NameCollisions {
+		collisions := nameCollisions(counts["nameids"])
+		for _, name := range sortedNames(collisions) {
+			for _, id := range collisions[name] {
+				cw.Write([]string{"collision:" + name, id, strconv.Itoa(counts["nameids"][name+"|"+id])})
+			}
+		}
+	}
+	if mr.IDConflicts {
+		conflicts := idConflicts(counts["idrecords"])
+		for _, id := range sortedConflicts(conflicts) {
+			for _, v := range conflicts[id] {
+				cw.Write([]string{"conflict:" + id, v.Name + "|" + v.Age + "|" + v.Diagnosis, strconv.Itoa(v.Count)})
+			}
+		}
+	}
+	if mr.CountBySource {
+		for _, kc := range sortedCounts(mr, counts["source"]) {
+			cw.Write([]string{"source", kc.Key, strconv.Itoa(kc.Count)})
+		}
+	}
+	if mr.AgeStats {
+		stats := ageSummaries(counts["agestats"])
+		for _, diagnosis := range sortedSummaries(stats) {
+			summary := stats[diagnosis]
+			cw.Write([]string{"agestats:" + diagnosis, "count", strconv.Itoa(summary.Count)})
+			cw.Write([]string{"agestats:" + diagnosis, "mean", strconv.FormatFloat(summary.Mean, 'f', -1, 64)})
+			cw.Write([]string{"agestats:" + diagnosis, "median", strconv.FormatFloat(summary.Median, 'f', -1, 64)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// AgeSummary describes the ages of the patients with one diagnosis
+type AgeSummary struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+}
+
+// ageSummaries computes an AgeSummary per diagnosis from counts keyed by
+// "diagnosis|age"
+func ageSummaries(counts map[string]int) map[string]AgeSummary {
+	byDiagnosis := make(map[string]map[int]int)
+	for key, count := range counts {
+		i := strings.LastIndexByte(key, '|')
+		age, err := strconv.Atoi(key[i+1:])
+		if err != nil {
+			continue
+		}
+		if byDiagnosis[key[:i]] == nil {
+			byDiagnosis[key[:i]] = make(map[int]int)
+		}
+		byDiagnosis[key[:i]][age] += count
+	}
+
+	summaries := make(map[string]AgeSummary)
+	for diagnosis, ageCounts := range byDiagnosis {
+		ages := make([]int, 0, len(ageCounts))
+		var summary AgeSummary
+		sum := 0
+		for age, count := range ageCounts {
+			ages = append(ages, age)
+			summary.Count += count
+			sum += age * count
+		}
+		sort.Ints(ages)
+		summary.Mean = float64(sum) / float64(summary.Count)
+		summary.Median = float64(nthAge(ages, ageCounts, (summary.Count-1)/2)+nthAge(ages, ageCounts, summary.Count/2)) / 2
+		summaries[diagnosis] = summary
+	}
+	return summaries
+}
+
+// nthAge returns the age at index n of the sorted ages, each repeated by
+// its count
+func nthAge(ages []int, counts map[int]int, n int) int {
+	for _, age := range ages {
+		if n < counts[age] {
+			return age
+		}
+		n -= counts[age]
+	}
+	return ages[len(ages)-1]
+}
+
+// sortedSummaries returns the diagnoses of summaries in alphabetical order
+func sortedSummaries(summaries map[string]AgeSummary) []string {
+	diagnoses := make([]string, 0, len(summaries))
+	for diagnosis := range summaries {
+		diagnoses = append(diagnoses, diagnosis)
+	}
+	sort.Strings(diagnoses)
+	return diagnoses
+}
+
+// groupCounts splits counts keyed by "outer|inner" into inner counts per
+// outer key
+func groupCounts(counts map[string]int) map[string]map[string]int {
+	grouped := make(map[string]map[string]int)
+	for key, count := range counts {
+		outer, inner, _ := strings.Cut(key, "|")
+		if grouped[outer] == nil {
+			grouped[outer] = make(map[string]int)
+		}
+		grouped[outer][inner] += count
+	}
+	return grouped
+}
+
+// sortedKeys returns the keys of grouped in alphabetical order
+func sortedKeys(grouped map[string]map[string]int) []string {
+	keys := make([]string, 0, len(grouped))
+	for key := range grouped {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeCrossTab writes the treatment counts for each diagnosis from counts
+// keyed by "diagnosis|treatment"
+func writeCrossTab(out io.Writer, mr *MapReduce, crossTabCounts map[string]int) error {
+	w := bufio.NewWriter(out)
+	byDiagnosis := groupCounts(crossTabCounts)
+
+	fmt.Fprintln(w, "Treatment Counts by Diagnosis:")
+	for _, diagnosis := range sortedKeys(byDiagnosis) {
+		fmt.Fprintf(w, "%v:\n", diagnosis)
+		for _, kc := range sortedCounts(mr, byDiagnosis[diagnosis]) {
+			fmt.Fprintf(w, "%v%s%v\n", kc.Key, mr.fieldSep(), kc.Count)
+		}
+	}
+	return w.Flush()
+}
+
+// writeAgeCounts writes a section per age bracket from counts keyed by
+// "bracket|diagnosis"
+func writeAgeCounts(out io.Writer, mr *MapReduce, ageCounts map[string]int) error {
+	w := bufio.NewWriter(out)
+	byBracket := groupCounts(ageCounts)
+
+	fmt.Fprintln(w, "Diagnosis Counts by Age Bracket:")
+	for _, label := range bracketLabels(mr) {
+		counts, ok := byBracket[label]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%v:\n", label)
+		for _, kc := range sortedCounts(mr, counts) {
+			fmt.Fprintf(w, "%v%s%v\n", kc.Key, mr.fieldSep(), kc.Count)
+		}
+	}
+	return w.Flush()
+}
+
+// bracketLabels returns the age bracket labels in report order, ending with
+// the unknown bracket
+func bracketLabels(mr *MapReduce) []string {
+	labels := make([]string, 0, len(mr.ageBrackets())+1)
+	for _, bracket := range mr.ageBrackets() {
+		labels = append(labels, bracket.Label)
+	}
+	return append(labels, unknownAgeBracket)
+}
+
+// KeyValue is an intermediate pair emitted by a MapFunc
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// MapFunc turns the contents of one input file into intermediate pairs
+type MapFunc func(filename, contents string) []KeyValue
+
+// ReduceFunc combines every value emitted for key into a single result
+type ReduceFunc func(key string, values []string) string
+
+// GenericMapTask runs mr.Map over filename and partitions its pairs across
+// NReduce intermediate files, each sorted by key
+func GenericMapTask(ctx context.Context, filename string, task int, mr *MapReduce, wg *sync.WaitGroup, results chan<- error) {
+	defer wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			results <- taskPanicError("map", task, r)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		results <- &TaskError{Phase: "map", Task: task, Err: err}
+		return
+	}
+	file, err := openInput(filename)
+	if err != nil {
+		results <- &TaskError{Phase: "map", Task: task, Err: err}
+		return
+	}
+	contents, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		results <- &TaskError{Phase: "map", Task: task, Err: err}
+		return
+	}
+
+	files := make([]io.WriteCloser, mr.NReduce)
+	encoders := make([]*json.Encoder, mr.NReduce)
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for r := range files {
+		file, err := createOutput(mr, intermediateName(mr, "kv", filename, task, r))
+		if err != nil {
+			results <- &TaskError{Phase: "map", Task: task, Err: err}
+			return
+		}
+		files[r] = file
+		encoders[r] = json.NewEncoder(file)
+	}
+
+	kvs := mr.Map(filename, string(contents))
+	sort.SliceStable(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	for _, kv := range kvs {
+		if err := encoders[ihash(kv.Key)%mr.NReduce].Encode(&kv); err != nil {
+			results <- &TaskError{Phase: "map", Task: task, Err: err}
+			return
+		}
+	}
+
+	for r, file := range files {
+		files[r] = nil
+		if err := file.Close(); err != nil {
+			results <- &TaskError{Phase: "map", Task: task, Err: err}
+			return
+		}
+	}
+	results <- nil
+}
+
+// kvStream reads the sorted pairs of one intermediate file
+type kvStream struct {
+	file io.ReadCloser
+	dec  *json.Decoder
+	pair KeyValue
+	ok   bool
+}
+
+// next advances to the following pair, clearing ok at the end of the file
+func (s *kvStream) next() error {
+	s.pair = KeyValue{}
+	err := s.dec.Decode(&s.pair)
+	if err == io.EOF {
+		s.ok = false
+		return nil
+	}
+	s.ok = err == nil
+	return err
+}
+
+// peek returns the key of the current pair
+func (s *kvStream) peek() (string, bool) {
+	return s.pair.Key, s.ok
+}
+
+// GenericReduceTask shuffles its partition by merging the sorted
+// intermediate files of every map task, and writes mr.Reduce's result for
+// each key to the partition's text output in key order. Only one key's
+// values are held in memory at a time; they are passed in map task order.
+func GenericReduceTask(ctx context.Context, task int, mr *MapReduce, wg *sync.WaitGroup, results chan<- error) {
+	defer wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			results <- taskPanicError("reduce", task, r)
+		}
+	}()
+	streams := make([]*kvStream, 0, mr.NMap)
+	defer func() {
+		for _, s := range streams {
+			s.file.Close()
+		}
+	}()
+	for i := 0; i < mr.NMap; i++ {
+		file, err := openInput(intermediateName(mr, "kv", mr.Files[i], i, task))
+		if err != nil {
+			results <- &TaskError{Phase: "reduce", Task: task, Err: err}
+			return
+		}
+		s := &kvStream{file: file, dec: json.NewDecoder(file)}
+		streams = append(streams, s)
+		if err := s.next(); err != nil {
+			results <- &TaskError{Phase: "reduce", Task: task, Err: err}
+			return
+		}
+	}
+
+	outputName, err := reduceOutputName(mr, task, "text")
+	if err != nil {
+		results <- &TaskError{Phase: "reduce", Task: task, Err: err}
+		return
+	}
+	outputFile, err := openOutput(mr, outputName)
+	if err != nil {
+		results <- &TaskError{Phase: "reduce", Task: task, Err: err}
+		return
+	}
+	w := bufio.NewWriter(outputFile)
+	var values []string
+	err = mergeByKey(ctx, streams, func(s *kvStream) error {
+		values = append(values, s.pair.Value)
+		return s.next()
+	}, func(key string) error {
+		fmt.Fprintf(w, "%v%s%v\n", key, mr.fieldSep(), mr.Reduce(key, values))
+		values = nil
+		return nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		results <- &TaskError{Phase: "reduce", Task: task, Err: err}
+		return
+	}
+	results <- nil
+}
+
+// RunGeneric runs the job defined by mr.Map and mr.Reduce over mr.Files,
+// removing the intermediate files afterwards unless KeepIntermediate is
+// set. If ctx is cancelled first, the error wraps ctx.Err().
+func RunGeneric(ctx context.Context, mr *MapReduce) error {
+	if mr.Map == nil || mr.Reduce == nil {
+		return fmt.Errorf("generic job requires Map and Reduce functions")
+	}
+	if len(mr.Files) == 0 {
+		return ErrNoInput
+	}
+	if err := mr.makeDirs(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	mapResults := make(chan error, mr.NMap)
+	mapSlots := make(chan struct{}, mr.maxParallelMap(mr.NMap))
+	for i, filename := range mr.Files {
+		wg.Add(1)
+		mapSlots <- struct{}{}
+		go func(filename string, task int) {
+			defer func() { <-mapSlots }()
+			GenericMapTask(ctx, filename, task, mr, &wg, mapResults)
+		}(filename, i)
+	}
+	wg.Wait()
+	close(mapResults)
+	for err := range mapResults {
+		if err != nil {
+			return err
+		}
+	}
+
+	reduceResults := make(chan error, mr.NReduce)
+	for i := 0; i < mr.NReduce; i++ {
+		wg.Add(1)
+		go GenericReduceTask(ctx, i, mr, &wg, reduceResults)
+	}
+	wg.Wait()
+	close(reduceResults)
+	for err := range reduceResults {
+		if err != nil {
+			return err
+		}
+	}
+	if !mr.KeepIntermediate {
+		return CleanupIntermediate(mr)
+	}
+	return nil
+}
+
+// WordCountMap emits each word of contents with a count of one
+func WordCountMap(filename, contents string) []KeyValue {
+	var kvs []KeyValue
+	for _, word := range strings.Fields(contents) {
+		kvs = append(kvs, KeyValue{Key: word, Value: "1"})
+	}
+	return kvs
+}
+
+// EHRCountMap emits "diagnosis:<value>" and "treatment:<value>" for each
+// well-formed EHR line, expressing the built-in counting job generically
+func EHRCountMap(filename, contents string) []KeyValue {
+	var kvs []KeyValue
+	for _, line := range strings.Split(contents, "\n") {
+		ehr, err := ParseEHR(line)
+		if err != nil {
+			continue
+		}
+		kvs = append(kvs,
+			KeyValue{Key: "diagnosis:" + ehr.Diagnosis, Value: "1"},
+			KeyValue{Key: "treatment:" + ehr.Treatment, Value: "1"})
+	}
+	return kvs
+}
+
+// CountReduce sums integer values
+func CountReduce(key string, values []string) string {
+	total := 0
+	for _, value := range values {
+		n, _ := strconv.Atoi(value)
+		total += n
+	}
+	return strconv.Itoa(total)
+}
+
+// Aggregator accumulates the values emitted for one key
+type Aggregator interface {
+	Add(value string)
+	Result() string
+}
+
+// AggregateReduce returns a ReduceFunc that feeds each key's values to a
+// fresh Aggregator from newAggregator
+func AggregateReduce(newAggregator func() Aggregator) ReduceFunc {
+	return func(key string, values []string) string {
+		agg := newAggregator()
+		for _, value := range values {
+			agg.Add(value)
+		}
+		return agg.Result()
+	}
+}
+
+// SumAggregator sums integer values
+type SumAggregator struct {
+	total int
+}
+
+// NewSumAggregator returns an empty SumAggregator
+func NewSumAggregator() Aggregator {
+	return &SumAggregator{}
+}
+
+// Add adds value to the total, ignoring non-integers
+func (a *SumAggregator) Add(value string) {
+	n, _ := strconv.Atoi(value)
+	a.total += n
+}
+
+// Result returns the total
+func (a *SumAggregator) Result() string {
+	return strconv.Itoa(a.total)
+}
+
+// MinMaxAggregator tracks the smallest or largest integer value
+type MinMaxAggregator struct {
+	max   bool
+	value int
+	seen  bool
+}
+
+// NewMinAggregator returns an aggregator reporting the smallest value
+func NewMinAggregator() Aggregator {
+	return &MinMaxAggregator{}
+}
+
+// NewMaxAggregator returns an aggregator reporting the largest value
+func NewMaxAggregator() Aggregator {
+	return &MinMaxAggregator{max: true}
+}
+
+// Add records value, ignoring non-integers
+func (a *MinMaxAggregator) Add(value string) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	if !a.seen || (a.max && n > a.value) || (!a.max && n < a.value) {
+		a.value = n
+		a.seen = true
+	}
+}
+
+// Result returns the smallest or largest value, or "" if none was valid
+func (a *MinMaxAggregator) Result() string {
+	if !a.seen {
+		return ""
+	}
+	return strconv.Itoa(a.value)
+}
+
+// DistinctAggregator counts distinct values
+type DistinctAggregator struct {
+	seen map[string]bool
+}
+
+// NewDistinctAggregator returns an empty DistinctAggregator
+func NewDistinctAggregator() Aggregator {
+	return &DistinctAggregator{seen: make(map[string]bool)}
+}
+
+// Add records value
+func (a *DistinctAggregator) Add(value string) {
+	a.seen[value] = true
+}
+
+// Result returns the number of distinct values added
+func (a *DistinctAggregator) Result() string {
+	return strconv.Itoa(len(a.seen))
+}
+
+// EHRPatientMap emits "diagnosis:<value>" with the PatientID of each
+// well-formed EHR line, for use with NewDistinctAggregator
+func EHRPatientMap(filename, contents string) []KeyValue {
+	var kvs []KeyValue
+	for _, line := range strings.Split(contents, "\n") {
+		ehr, err := ParseEHR(line)
+		if err != nil {
+			continue
+		}
+		kvs = append(kvs, KeyValue{Key: "diagnosis:" + ehr.Diagnosis, Value: ehr.PatientID})
+	}
+	return kvs
+}
+
+// EHRAgeMap emits "diagnosis:<value>" with the age of each well-formed EHR
+// line, for use with NewMinAggregator or NewMaxAggregator
+func EHRAgeMap(filename, contents string) []KeyValue {
+	var kvs []KeyValue
+	for _, line := range strings.Split(contents, "\n") {
+		ehr, err := ParseEHR(line)
+		if err != nil {
+			continue
+		}
+		age, err := ParseAge(ehr.Age)
+		if err != nil {
+			continue
+		}
+		kvs = append(kvs, KeyValue{Key: "diagnosis:" + ehr.Diagnosis, Value: strconv.Itoa(age)})
+	}
+	return kvs
+}
+
+// CleanupIntermediate removes the intermediate files written by the map phase
+func CleanupIntermediate(mr *MapReduce) error {
+	kinds := intermediateKinds
+	for _, field := range mr.groupByFields() {
+		if ehrFields[field] == nil {
+			kinds = append(kinds[:len(kinds):len(kinds)], fieldKind(field))
+		}
+	}
+	for i := 0; i < mr.NMap; i++ {
+		for _, kind := range kinds {
+			for r := 0; r < mr.NReduce; r++ {
+				name := intermediateName(mr, kind, mr.Files[i], i, r)
+				for _, path := range []string{name, name + checksumExt} {
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+		}
+	}
+	for _, kind := range kinds {
+		for r := 0; r < mr.NReduce; r++ {
+			_, err := combineTree(mr, kind, r, func(inputs []string, output string) error {
+				for _, path := range []string{output, output + checksumExt} {
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DiscoverInputs returns the EHR files named by input, which is either a
+// directory to scan for .txt and .txt.gz files or a glob pattern. When
+// recursive is set, a directory is walked and files in its subdirectories
+// are included too. Intermediate and reduce output files left over from
+// earlier runs are excluded.
+func DiscoverInputs(input string, recursive bool) ([]string, error) {
+	var candidates []string
+	if info, err := os.Stat(input); err == nil && info.IsDir() && recursive {
+		err := filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && isInputName(d.Name()) {
+				candidates = append(candidates, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err == nil && info.IsDir() {
+		files, err := ioutil.ReadDir(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !file.IsDir() && isInputName(file.Name()) {
+				candidates = append(candidates, filepath.Join(input, file.Name()))
+			}
+		}
+	} else {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, err
+		}
+		candidates = matches
+	}
+
+	var filenames []string
+	for _, candidate := range candidates {
+		if isGeneratedFile(filepath.Base(candidate)) {
+			continue
+		}
+		filenames = append(filenames, candidate)
+	}
+	return filenames, nil
+}
+
+// isInputName reports whether name has an EHR input extension.
+func isInputName(name string) bool {
+	return strings.HasSuffix(name, ".txt") || strings.HasSuffix(name, ".txt.gz")
+}
+
+// generatedFilePattern matches the names intermediateName, spillName,
+// combineName, reduceOutputName, mergedOutputName and rejectsName build.
+// Map file names from before the input hash was added still match.
+// Only rejects files suffixed with a NewRunID timestamp match, so that an
+// input such as rejects-2023.txt is kept.
+var generatedFilePattern = regexp.MustCompile(`^(` +
+	`(map|spill)-[a-z][^-]*(-[0-9a-f]{8})?-[0-9]+-[0-9]+\.(txt|gob)` +
+	`|combine-[a-z][^-]*-[0-9]+-[0-9]+-[0-9]+\.(txt|gob)` +
+	`|reduce-out(-.+)?\.(txt|json|csv)` +
+	`|rejects(-[0-9]{8}-[0-9]{6})?\.txt` +
+	`)(\.gz)?(\.sha256)?$`)
+
+// isGeneratedFile reports whether name is that of a file written by a run
+func isGeneratedFile(name string) bool {
+	return generatedFilePattern.MatchString(name)
+}
+
+// ErrNoInput is returned by Run when the job has no input files
+var ErrNoInput = errors.New("no input files found")
+
+// ErrNoMoreTasks matches, via errors.Is, the errors the master returns once
+// its map or reduce task queue is drained
+var ErrNoMoreTasks = errors.New("no more tasks")
+
+// noMoreTasksError is returned by the master when no tasks of a phase remain
+type noMoreTasksError string
+
+// Error names the drained phase, as in "no more map tasks"
+func (e noMoreTasksError) Error() string {
+	return "no more " + string(e) + " tasks"
+}
+
+// Is reports whether target is ErrNoMoreTasks, so that errors.Is matches a
+// drained queue of either phase against it. Over RPC only the message
+// survives; workers compare it with errNoMoreMapTasks or
+// errNoMoreReduceTasks instead.
+func (e noMoreTasksError) Is(target error) bool {
+	return target == ErrNoMoreTasks
+}
+
+// Errors returned by the master once its task queues are drained
+var (
+	errNoMoreMapTasks    error = noMoreTasksError("map")
+	errNoMoreReduceTasks error = noMoreTasksError("reduce")
+	errMapTasksPending         = errors.New("map tasks in progress")
+)
+
+// workerPollInterval is how long a worker waits before asking again while
+// map tasks are in progress elsewhere
+const workerPollInterval = 100 * time.Millisecond
+
+// defaultReduceRetries bounds a reduce worker's wait for the map phase to
+// about a minute when ReduceRetries is unset
+const defaultReduceRetries = 600
+
+// Dial retry policy: up to dialAttempts tries, waiting dialBackoff after the
+// first failure and doubling the wait after each one
+const (
+	dialAttempts = 6
+	dialBackoff  = 20 * time.Millisecond
+)
+
+// dialMaster connects to the master at addr, retrying with exponential
+// backoff while it is not yet listening
+func dialMaster(ctx context.Context, addr string) (*rpc.Client, error) {
+	backoff := dialBackoff
+	for attempt := 1; ; attempt++ {
+		client, err := rpc.Dial("tcp", addr)
+		if err == nil || attempt == dialAttempts {
+			return client, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// MasterOption configures a Master created by NewMaster or NewMasterContext
+type MasterOption func(*Master)
+
+// WithAddr sets the address the master serves on
+func WithAddr(addr string) MasterOption {
+	return func(m *Master) {
+		m.Addr = addr
+	}
+}
+
+// WithTaskTimeout overrides mr.TaskTimeout for the master
+func WithTaskTimeout(timeout time.Duration) MasterOption {
+	return func(m *Master) {
+		m.taskTimeout = timeout
+	}
+}
+
+// NewMaster function
+func NewMaster(mr *MapReduce, opts ...MasterOption) *Master {
+	return NewMasterContext(context.Background(), mr, opts...)
+}
+
+// NewMasterContext creates a master that stops handing out tasks once ctx
+// is cancelled
+func NewMasterContext(ctx context.Context, mr *MapReduce, opts ...MasterOption) *Master {
+	m := &Master{
+		ctx:         ctx,
+		taskTimeout: mr.TaskTimeout,
+		conns:       make(map[net.Conn]bool),
+	}
+	m.init(mr)
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.requeues() {
+		go m.reap(m.mapsComplete)
+	}
+	return m
+}
+
+// init fills the task queues for mr and clears the job's state
+func (m *Master) init(mr *MapReduce) {
+	m.mr = mr
+	m.mapTasks = make(chan int, mr.NMap)
+	m.reduceTasks = make(chan int, mr.NReduce)
+	for i := 0; i < mr.NMap; i++ {
+		m.mapTasks <- i
+	}
+	for i := 0; i < mr.NReduce; i++ {
+		m.reduceTasks <- i
+	}
+	m.done = make(chan struct{})
+	m.doneOnce = sync.Once{}
+	m.mapDone = make(map[int]bool)
+	m.reduceDone = make(map[int]bool)
+	m.mapAssigned = make(map[int]time.Time)
+	m.mapOwner = make(map[int]string)
+	m.lastSeen = make(map[string]time.Time)
+	m.deadWorkers = make(map[string]bool)
+	m.stats = MasterStats{
+		MapTasks:    make(map[string]int),
+		ReduceTasks: make(map[string]int),
+		Records:     make(map[string]RecordStats),
+	}
+	m.requeued = 0
+	m.mapsComplete = make(chan struct{})
+	if mr.NMap == 0 {
+		close(m.mapsComplete)
+	}
+}
+
+// Reset prepares the master to run the job described by mr, refilling its
+// task queues and clearing the previous job's progress and stats, while it
+// keeps serving on the same address. It must not be called while workers
+// are claiming tasks. A TaskTimeout in mr replaces the master's.
+func (m *Master) Reset(mr *MapReduce) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mapDone) < m.mr.NMap {
+		// Stop the previous job's reaper and release its waiters
+		close(m.mapsComplete)
+	}
+	if mr.TaskTimeout > 0 {
+		m.taskTimeout = mr.TaskTimeout
+	}
+	m.init(mr)
+	if m.requeues() {
+		go m.reap(m.mapsComplete)
+	}
+}
+
+// requeues reports whether handed-out map tasks may be re-queued
+func (m *Master) requeues() bool {
+	return m.taskTimeout > 0 || m.mr.HeartbeatTimeout > 0
+}
+
+// AssignMapTask function
+func (m *Master) AssignMapTask(args TaskArgs, reply *int) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	if m.mr.Ordered {
+		return m.assignNextMapTask(args, reply)
+	}
+	for {
+		select {
+		case task := <-m.mapTasks:
+			m.mu.Lock()
+			if m.mapDone[task] {
+				// A re-queued task finished after all
+				m.mu.Unlock()
+				continue
+			}
+			now := time.Now()
+			m.mapAssigned[task] = now
+			m.mapOwner[task] = args.WorkerID
+			m.stats.MapTasks[args.WorkerID]++
+			if args.WorkerID != "" {
+				m.lastSeen[args.WorkerID] = now
+				delete(m.deadWorkers, args.WorkerID)
+			}
+			m.mu.Unlock()
+			m.mr.logger().Debug("map task assigned", "task", task, "worker", args.WorkerID)
+			*reply = task
+			return nil
+		default:
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.requeues() && len(m.mapDone) < m.mr.NMap {
+				return errMapTasksPending
+			}
+			return errNoMoreMapTasks
+		}
+	}
+}
+
+// assignNextMapTask assigns the lowest-numbered unfinished map task once no
+// other task is outstanding, for Ordered jobs
+func (m *Master) assignNextMapTask(args TaskArgs, reply *int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mapAssigned) > 0 {
+		return errMapTasksPending
+	}
+	for task := 0; task < m.mr.NMap; task++ {
+		if m.mapDone[task] {
+			continue
+		}
+		now := time.Now()
+		m.mapAssigned[task] = now
+		m.mapOwner[task] = args.WorkerID
+		m.stats.MapTasks[args.WorkerID]++
+		if args.WorkerID != "" {
+			m.lastSeen[args.WorkerID] = now
+			delete(m.deadWorkers, args.WorkerID)
+		}
+		m.mr.logger().Debug("map task assigned", "task", task, "worker", args.WorkerID)
+		*reply = task
+		return nil
+	}
+	return errNoMoreMapTasks
+}
+
+// Ping replies "ok" when the master is ready to assign tasks. Task queues
+// are filled before a master is returned, so a served master is ready
+// until its context is cancelled.
+func (m *Master) Ping(args int, reply *string) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	*reply = "ok"
+	return nil
+}
+
+// Heartbeat records that workerID is alive
+func (m *Master) Heartbeat(workerID string, reply *bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSeen[workerID] = time.Now()
+	delete(m.deadWorkers, workerID)
+	*reply = true
+	return nil
+}
+
+// reap re-queues map tasks that have not been acknowledged within
+// TaskTimeout of being assigned, or whose worker has missed heartbeats for
+// HeartbeatTimeout, until mapsComplete is closed
+func (m *Master) reap(mapsComplete <-chan struct{}) {
+	interval := m.taskTimeout
+	if interval <= 0 || (m.mr.HeartbeatTimeout > 0 && m.mr.HeartbeatTimeout < interval) {
+		interval = m.mr.HeartbeatTimeout
+	}
+	if interval/2 > 0 {
+		interval /= 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mapsComplete:
+			return
+		case <-m.ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			if m.mr.HeartbeatTimeout > 0 {
+				for worker, seen := range m.lastSeen {
+					if now.Sub(seen) >= m.mr.HeartbeatTimeout {
+						m.deadWorkers[worker] = true
+					}
+				}
+			}
+			for task, assigned := range m.mapAssigned {
+				expired := m.taskTimeout > 0 && now.Sub(assigned) >= m.taskTimeout
+				if expired || m.deadWorkers[m.mapOwner[task]] {
+					m.mr.logger().Info("map task requeued", "task", task, "worker", m.mapOwner[task], "expired", expired)
+					delete(m.mapAssigned, task)
+					delete(m.mapOwner, task)
+					m.requeued++
+					if !m.mr.Ordered {
+						// Ordered jobs pick tasks without the queue
+						m.mapTasks <- task
+					}
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// AssignReduceTask assigns a reduce task once every map task is complete,
+// so that reducers never read partially written intermediates. Until then
+// it returns errMapTasksPending.
+func (m *Master) AssignReduceTask(args TaskArgs, reply *int) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-m.mapsComplete:
+	default:
+		return errMapTasksPending
+	}
+	select {
+	case task := <-m.reduceTasks:
+		m.mu.Lock()
+		m.stats.ReduceTasks[args.WorkerID]++
+		m.mu.Unlock()
+		m.mr.logger().Debug("reduce task assigned", "task", task, "worker", args.WorkerID)
+		*reply = task
+		return nil
+	default:
+		return errNoMoreReduceTasks
+	}
+}
+
+// CompleteMapTask records that a worker finished a map task
+func (m *Master) CompleteMapTask(args CompleteArgs, reply *bool) error {
+	task := args.Task
+	if task < 0 || task >= m.mr.NMap {
+		return fmt.Errorf("invalid map task %d", task)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mapAssigned, task)
+	delete(m.mapOwner, task)
+	if !m.mapDone[task] {
+		m.mapDone[task] = true
+		file := m.mr.Files[task]
+		m.stats.Records[file] = m.stats.Records[file].add(args.Stats)
+		m.mr.logger().Debug("map task completed", "task", task, "done", len(m.mapDone), "total", m.mr.NMap)
+		m.mr.progress("map", len(m.mapDone), m.mr.NMap)
+		if len(m.mapDone) == m.mr.NMap {
+			close(m.mapsComplete)
+		}
+	}
+	*reply = true
+	return nil
+}
+
+// CompleteReduceTask records that a worker finished a reduce task
+func (m *Master) CompleteReduceTask(task int, reply *bool) error {
+	if task < 0 || task >= m.mr.NReduce {
+		return fmt.Errorf("invalid reduce task %d", task)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reduceDone[task] = true
+	m.mr.logger().Debug("reduce task completed", "task", task)
+	*reply = true
+	return nil
+}
+
+// Serve registers the master with a new RPC server listening on m.Addr and
+// accepts connections in the background until Shutdown is called
+func (m *Master) Serve() (net.Listener, error) {
+	server := rpc.NewServer()
+	if err := server.Register(m); err != nil {
+		return nil, err
+	}
+	addr := m.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m.Addr = dialAddr(listener.Addr())
+	m.mu.Lock()
+	m.listener = listener
+	m.mu.Unlock()
+	go m.accept(server, listener)
+	return listener, nil
+}
+
+// accept serves each connection made to listener until it is closed
+func (m *Master) accept(server *rpc.Server, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.mu.Lock()
+			shutdown := m.shutdown
+			m.mu.Unlock()
+			if !shutdown {
+				log.Printf("master accept: %v", err)
+			}
+			return
+		}
+		m.mu.Lock()
+		if m.shutdown {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.conns[conn] = true
+		m.mu.Unlock()
+		go func() {
+			server.ServeConn(conn)
+			m.mu.Lock()
+			delete(m.conns, conn)
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops the master accepting connections and closes those already
+// open. It is safe to call more than once.
+func (m *Master) Shutdown() error {
+	m.mu.Lock()
+	if m.shutdown {
+		m.mu.Unlock()
+		return nil
+	}
+	m.shutdown = true
+	listener := m.listener
+	conns := m.conns
+	m.conns = make(map[net.Conn]bool)
+	m.mu.Unlock()
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// dialAddr converts a listener address into one clients can dial,
+// substituting localhost for an unspecified host
+func dialAddr(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Stats returns a snapshot of the per-worker task assignment counts
+func (m *Master) Stats(args int, reply *MasterStats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reply.MapTasks = make(map[string]int, len(m.stats.MapTasks))
+	for worker, n := range m.stats.MapTasks {
+		reply.MapTasks[worker] = n
+	}
+	reply.ReduceTasks = make(map[string]int, len(m.stats.ReduceTasks))
+	for worker, n := range m.stats.ReduceTasks {
+		reply.ReduceTasks[worker] = n
+	}
+	reply.Records = make(map[string]RecordStats, len(m.stats.Records))
+	for file, records := range m.stats.Records {
+		reply.Records[file] = records
+	}
+	return nil
+}
+
+// ServeHTTP writes the master's task and record counters in the Prometheus
+// text exposition format
+func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	var mapAssigned, reduceAssigned int
+	for _, n := range m.stats.MapTasks {
+		mapAssigned += n
+	}
+	for _, n := range m.stats.ReduceTasks {
+		reduceAssigned += n
+	}
+	var records RecordStats
+	for _, fileRecords := range m.stats.Records {
+		records = records.add(fileRecords)
+	}
+	metrics := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"mapreduce_map_tasks_assigned_total", "Map tasks assigned to workers.", mapAssigned},
+		{"mapreduce_map_tasks_completed_total", "Map tasks completed.", len(m.mapDone)},
+		{"mapreduce_map_tasks_requeued_total", "Map tasks re-queued after a timeout or dead worker.", m.requeued},
+		{"mapreduce_reduce_tasks_assigned_total", "Reduce tasks assigned to workers.", reduceAssigned},
+		{"mapreduce_reduce_tasks_completed_total", "Reduce tasks completed.", len(m.reduceDone)},
+		{"mapreduce_records_read_total", "Input records read by completed map tasks.", records.Read},
+		{"mapreduce_records_counted_total", "Input records counted by completed map tasks.", records.Counted},
+		{"mapreduce_parse_errors_total", "Input records skipped as malformed or invalid.", records.Skipped},
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", metric.name, metric.help, metric.name, metric.name, metric.value)
+	}
+}
+
+// Done signals that the job has finished. It may be called any number of
+// times, before or after Wait.
+func (m *Master) Done(args int, reply *string) error {
+	m.doneOnce.Do(func() { close(m.done) })
+	*reply = "All tasks are done"
+	return nil
+}
+
+// Wait blocks until every map task has been acknowledged complete and Done
+// has been called
+func (m *Master) Wait() {
+	m.WaitMaps()
+	<-m.done
+}
+
+// WaitMaps blocks until every map task has been acknowledged complete
+func (m *Master) WaitMaps() {
+	m.mu.Lock()
+	mapsComplete := m.mapsComplete
+	m.mu.Unlock()
+	<-mapsComplete
+}
+
+// workerSeq numbers the workers started by this process
+var workerSeq int64
+
+// workerIDOrDefault returns workerID, or if it is empty one unique to this
+// process
+func workerIDOrDefault(workerID string) string {
+	if workerID == "" {
+		return fmt.Sprintf("worker-%d-%d", os.Getpid(), atomic.AddInt64(&workerSeq, 1))
+	}
+	return workerID
+}
+
+// RunWorker dials the master at masterAddr and claims map tasks as workerID
+// until none remain or ctx is cancelled, running each one against the job
+// described by mr. An empty workerID is replaced by one unique to this
+// process. While running it sends heartbeats if mr.HeartbeatTimeout is set.
+func RunWorker(ctx context.Context, masterAddr string, workerID string, mr *MapReduce) error {
+	client, err := dialMaster(ctx, masterAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var ready string
+	if err := client.Call("Master.Ping", 0, &ready); err != nil {
+		return fmt.Errorf("master not ready: %w", err)
+	}
+
+	args := TaskArgs{WorkerID: workerIDOrDefault(workerID)}
+	if mr.HeartbeatTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go heartbeat(client, args.WorkerID, mr.HeartbeatTimeout/3, stop)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var task int
+		if err := client.Call("Master.AssignMapTask", args, &task); err != nil {
+			switch err.Error() {
+			case errNoMoreMapTasks.Error():
+				return nil
+			case errMapTasksPending.Error():
+				select {
+				case <-ctx.Done():
+				case <-time.After(workerPollInterval):
+				}
+				continue
+			}
+			return err
+		}
+
+		var wg sync.WaitGroup
+		results := make(chan MapResult, 1)
+		wg.Add(1)
+		MapTask(ctx, mr.Files[task], task, mr, mr.parser(), &wg, results)
+		result := <-results
+		if result.Err != nil {
+			return taskError("map", task, result.Err)
+		}
+
+		var ok bool
+		if err := client.Call("Master.CompleteMapTask", CompleteArgs{Task: task, Stats: result.RecordStats}, &ok); err != nil {
+			return err
+		}
+	}
+}
+
+// RunReduceWorker dials the master at masterAddr and claims reduce tasks as
+// workerID until none remain or ctx is cancelled, writing each partition's
+// output. An empty workerID is replaced by one unique to this process. While
+// map tasks are in progress it waits and asks again, up to mr.ReduceRetries
+// times.
+func RunReduceWorker(ctx context.Context, masterAddr string, workerID string, mr *MapReduce) error {
+	client, err := dialMaster(ctx, masterAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	retries := mr.ReduceRetries
+	if retries <= 0 {
+		retries = defaultReduceRetries
+	}
+	args := TaskArgs{WorkerID: workerIDOrDefault(workerID)}
+	for waits := 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var task int
+		if err := client.Call("Master.AssignReduceTask", args, &task); err != nil {
+			switch err.Error() {
+			case errNoMoreReduceTasks.Error():
+				return nil
+			case errMapTasksPending.Error():
+				if waits++; waits > retries {
+					return fmt.Errorf("map tasks still in progress after %d retries", retries)
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(workerPollInterval):
+				}
+				continue
+			}
+			return err
+		}
+
+		var err error
+		if mr.streamsReduceOutput() {
+			err = streamReduceOutput(ctx, mr, task)
+		} else {
+			var counts kindCounts
+			counts, err = reducePartition(ctx, task, mr)
+			if err == nil {
+				err = writeReduceOutput(mr, task, counts)
+			}
+		}
+		if err != nil {
+			return taskError("reduce", task, err)
+		}
+		var ok bool
+		if err := client.Call("Master.CompleteReduceTask", task, &ok); err != nil {
+			return err
+		}
+	}
+}
+
+// heartbeat reports workerID as alive every interval until stop is closed
+func heartbeat(client *rpc.Client, workerID string, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var ok bool
+			client.Call("Master.Heartbeat", workerID, &ok)
+		}
+	}
+}
+
+// Plan describes the work Run would do for a job
+type Plan struct {
+	Files       []string
+	MapTasks    int
+	ReduceTasks int
+	TempDir     string
+	Outputs     []string
+}
+
+// PlanJob returns the plan for mr without running it
+func PlanJob(mr *MapReduce) (Plan, error) {
+	plan := Plan{
+		MapTasks:    mr.NMap,
+		ReduceTasks: mr.NReduce,
+		TempDir:     mr.intermediateDir(),
+	}
+	for i, file := range mr.Files {
+		// Splits of one file are listed once
+		if i == 0 || file != mr.Files[i-1] {
+			plan.Files = append(plan.Files, file)
+		}
+	}
+	for _, format := range mr.outputFormats() {
+		if mr.MergeOutput {
+			name, err := mergedOutputName(mr, format)
+			if err != nil {
+				return Plan{}, err
+			}
+			plan.Outputs = append(plan.Outputs, name)
+			continue
+		}
+		for i := 0; i < mr.NReduce; i++ {
+			name, err := reduceOutputName(mr, i, format)
+			if err != nil {
+				return Plan{}, err
+			}
+			plan.Outputs = append(plan.Outputs, name)
+		}
+	}
+	return plan, nil
+}
+
+// String formats the plan for display
+func (p Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Input files (%d):\n", len(p.Files))
+	for _, file := range p.Files {
+		fmt.Fprintf(&b, "  %s\n", file)
+	}
+	fmt.Fprintf(&b, "Map tasks: %d\n", p.MapTasks)
+	fmt.Fprintf(&b, "Reduce tasks: %d\n", p.ReduceTasks)
+	if p.TempDir != "" {
+		fmt.Fprintf(&b, "Intermediate directory: %s\n", p.TempDir)
+	}
+	fmt.Fprintln(&b, "Outputs:")
+	for _, output := range p.Outputs {
+		fmt.Fprintf(&b, "  %s\n", output)
+	}
+	return b.String()
+}
+
+// manifestName is the file in OutputDir recording the last successful run
+const manifestName = "manifest.json"
+
+// Manifest records the inputs, options and outputs of a successful run so
+// that an unchanged re-run can be skipped
+type Manifest struct {
+	Inputs  []ManifestInput `json:"inputs"`
+	Options string          `json:"options"`
+	Outputs []string        `json:"outputs"`
+}
+
+// ManifestInput identifies the version of an input file a run read
+type ManifestInput struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// NewManifest describes the current inputs and options of mr
+func NewManifest(mr *MapReduce) (Manifest, error) {
+	plan, err := PlanJob(mr)
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest := Manifest{Options: manifestOptions(mr), Outputs: plan.Outputs}
+	for _, file := range plan.Files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return Manifest{}, err
+		}
+		manifest.Inputs = append(manifest.Inputs, ManifestInput{Path: file, Size: info.Size(), ModTime: info.ModTime().UTC()})
+	}
+	return manifest, nil
+}
+
+// manifestOptions summarizes the options that affect reduce output. Filter
+// functions cannot be compared, so changing one requires Force.
+func manifestOptions(mr *MapReduce) string {
+	return fmt.Sprintf("parser=%T%+v schema=%v nameTokens=%d skipHeader=%t fieldSep=%q fields=%v byAge=%t brackets=%v crossTab=%t collisions=%t idConflicts=%t bySource=%t ageStats=%t rejects=%t normalize=%v missing=%q/%t categories=%q/%q validateAge=%t idPattern=%v dedup=%t/%t merge=%t incremental=%t format=%v sort=%s top=%d min=%d",
+		mr.parser(), mr.parser(), mr.Schema, mr.NameTokens, mr.SkipHeader, mr.FieldSep, mr.groupByFields(), mr.GroupByAge, mr.ageBrackets(), mr.CrossTab, mr.NameCollisions, mr.IDConflicts, mr.CountBySource, mr.AgeStats, mr.WriteRejects,
+		mr.normalizeFields(), mr.MissingValues, mr.ExcludeMissing, mr.TreatmentCategories, mr.UnmappedTreatment, mr.ValidateAge, mr.PatientIDPattern, mr.Dedup, mr.DedupByDiagnosis, mr.MergeOutput, mr.Incremental, mr.outputFormats(), mr.SortBy, mr.TopN, mr.MinCount)
+}
+
+// ReadManifest reads the manifest left in dir by a previous run
+func ReadManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// WriteManifest records manifest in dir
+func WriteManifest(dir string, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, manifestName), append(data, '\n'), 0644)
+}
+
+// totalsName is the file in OutputDir holding an Incremental run's counts
+const totalsName = "totals.json"
+
+// readTotals reads the counts saved by the last Incremental run
+func readTotals(mr *MapReduce) (kindCounts, error) {
+	data, err := ioutil.ReadFile(filepath.Join(mr.OutputDir, totalsName))
+	if err != nil {
+		return nil, err
+	}
+	var totals kindCounts
+	if err := json.Unmarshal(data, &totals); err != nil {
+		return nil, &IOError{Op: "decode", Path: totalsName, Err: err}
+	}
+	return totals, nil
+}
+
+// writeTotals saves counts for the next Incremental run
+func writeTotals(mr *MapReduce, totals kindCounts) error {
+	data, err := json.Marshal(totals)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(mr.OutputDir, totalsName), append(data, '\n'), 0644)
+}
+
+// incrementalInputs narrows mr's map tasks to the inputs of current that
+// the last run did not read, returning that run's totals. It reports false,
+// leaving mr unchanged, if the last run's results cannot be extended.
+func incrementalInputs(mr *MapReduce, current Manifest) (kindCounts, bool) {
+	previous, err := ReadManifest(mr.OutputDir)
+	if err != nil || previous.Options != current.Options || !reflect.DeepEqual(previous.Outputs, current.Outputs) {
+		return nil, false
+	}
+	totals, err := readTotals(mr)
+	if err != nil {
+		return nil, false
+	}
+	unchanged := make(map[ManifestInput]bool, len(current.Inputs))
+	for _, input := range current.Inputs {
+		unchanged[input] = true
+	}
+	processed := make(map[string]bool, len(previous.Inputs))
+	for _, input := range previous.Inputs {
+		if !unchanged[input] {
+			return nil, false
+		}
+		processed[input.Path] = true
+	}
+
+	var files []string
+	var splits []InputSplit
+	for i, file := range mr.Files {
+		if processed[file] {
+			continue
+		}
+		files = append(files, file)
+		if i < len(mr.Splits) {
+			splits = append(splits, mr.Splits[i])
+		}
+	}
+	mr.Files, mr.Splits, mr.NMap = files, splits, len(files)
+	return totals, true
+}
+
+// partitionCounts divides counts among the reduce partitions their keys
+// are routed to
+func partitionCounts(mr *MapReduce, counts kindCounts) []kindCounts {
+	partitions := make([]kindCounts, mr.NReduce)
+	for r := range partitions {
+		partitions[r] = make(kindCounts)
+	}
+	for kind, keyCounts := range counts {
+		for key, count := range keyCounts {
+			r := partition(mr, kind, key)
+			if partitions[r][kind] == nil {
+				partitions[r][kind] = make(map[string]int)
+			}
+			partitions[r][kind][key] += count
+		}
+	}
+	return partitions
+}
+
+// upToDate reports whether the previous run's manifest matches current and
+// all of its outputs still exist
+func upToDate(mr *MapReduce, current Manifest) bool {
+	previous, err := ReadManifest(mr.OutputDir)
+	if err != nil || !reflect.DeepEqual(previous, current) {
+		return false
+	}
+	for _, output := range current.Outputs {
+		if _, err := os.Stat(output); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Run executes the job described by mr: map tasks are claimed by workers
+// through the master over RPC, then the reduce tasks run concurrently. It
+// returns the job's Result, or the first error encountered rather than
+// exiting, or ctx.Err() if ctx is cancelled first. A dry run returns only
+// the job's Plan.
+func Run(ctx context.Context, mr *MapReduce) (*Result, error) {
+	return run(ctx, mr, true)
+}
+
+// Result holds a job's counts summed across all reduce partitions. TopN,
+// SortBy and MinCount apply only to file output, so every key is present.
+type Result struct {
+	Diagnosis map[string]int
+	Treatment map[string]int
+	// Fields maps each of GroupByFields other than Diagnosis and Treatment
+	// to its counts
+	Fields map[string]map[string]int
+	// AgeBrackets maps each age bracket to its diagnosis counts when
+	// GroupByAge is set
+	AgeBrackets map[string]map[string]int
+	// CrossTab maps each diagnosis to its treatment counts when CrossTab is
+	// set
+	CrossTab map[string]map[string]int
+	// Outputs lists the reduce output files written
+	Outputs []string
+	// NameCollisions maps each name seen with several PatientIDs to those
+	// IDs when NameCollisions is set
+	NameCollisions map[string][]string
+	// IDConflicts maps each PatientID seen with differing records to those
+	// records when IDConflicts is set
+	IDConflicts map[string][]RecordVariant
+	// AgeStats summarizes the ages for each diagnosis when AgeStats is set
+	AgeStats map[string]AgeSummary
+	// Sources maps each input file to the number of records counted from it
+	// when CountBySource is set
+	Sources map[string]int
+	// Records sums the record counts of every map task, and FileRecords
+	// breaks them down by input file
+	Records     RecordStats
+	FileRecords map[string]RecordStats
+	// UpToDate is set when Run skipped the job because its inputs and
+	// options are unchanged since the last run. The Result holds no counts.
+	UpToDate bool
+	// Plan is the job's plan when DryRun is set. The Result holds no counts.
+	Plan *Plan
+}
+
+// RunInMemory runs the job like Run but without writing reduce output
+// files. A dry run returns only the job's Plan.
+func RunInMemory(ctx context.Context, mr *MapReduce) (*Result, error) {
+	return run(ctx, mr, false)
+}
+
+// reduceResult is a reduce partition's counts or the error that stopped it
+type reduceResult struct {
+	task   int
+	counts kindCounts
+	err    error
+}
+
+// run executes the job, writing reduce output files if writeOutput is set
+func run(ctx context.Context, mr *MapReduce, writeOutput bool) (_ *Result, err error) {
+	if mr.JobTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mr.JobTimeout)
+		defer cancel()
+		defer func() {
+			if parent.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("job exceeded timeout of %v: %w", mr.JobTimeout, err)
+			}
+		}()
+	}
+
+	if len(mr.InputReaders) > 0 && len(mr.Files) == 0 {
+		for i := range mr.InputReaders {
+			mr.Files = append(mr.Files, fmt.Sprintf("input-%d", i))
+		}
+		mr.NMap = len(mr.Files)
+	}
+	if len(mr.Files) == 0 {
+		return nil, ErrNoInput
+	}
+	if err := mr.validateFields(); err != nil {
+		return nil, err
+	}
+	if format := mr.IntermediateFormat; format != "" && format != "text" && format != "gob" {
+		return nil, fmt.Errorf("unknown intermediate format %q", format)
+	}
+	if mr.SplitSize > 0 && mr.Splits == nil && mr.InputReaders == nil {
+		if err := SplitInputs(mr); err != nil {
+			return nil, err
+		}
+	}
+
+	if mr.DryRun {
+		plan, err := PlanJob(mr)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Plan: &plan}, nil
+	}
+
+	if err := mr.makeDirs(); err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	var base kindCounts
+	useManifest := writeOutput && mr.InputReaders == nil && mr.OutputSink == nil
+	if useManifest {
+		var err error
+		if manifest, err = NewManifest(mr); err != nil {
+			return nil, err
+		}
+		if !mr.Force && upToDate(mr, manifest) {
+			mr.logger().Info("inputs unchanged since the last run")
+			return &Result{UpToDate: true}, nil
+		}
+		if mr.Incremental && !mr.Force {
+			var ok bool
+			if base, ok = incrementalInputs(mr, manifest); ok {
+				mr.logger().Info("incremental run", "files", mr.NMap)
+			}
+		}
+	}
+	// baseParts holds an incremental run's previous totals by partition
+	baseParts := partitionCounts(mr, base)
+
+	master := NewMasterContext(ctx, mr, WithAddr(mr.Addr))
+
+	if _, err := master.Serve(); err != nil {
+		return nil, fmt.Errorf("listener error: %w", err)
+	}
+	defer master.Shutdown()
+	if mr.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", mr.MetricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("metrics listener error: %w", err)
+		}
+		defer listener.Close()
+		go http.Serve(listener, master)
+	}
+
+	workers := mr.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+		if mr.SplitSize > 0 {
+			workers = max(workers, min(mr.NMap, runtime.NumCPU()))
+		}
+	}
+	workers = mr.maxParallelMap(workers)
+	if mr.Ordered {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	mapResults := make(chan error, workers)
+	reduceResults := make(chan reduceResult, mr.NReduce)
+
+	// Map tasks are claimed from the master by workers over RPC
+	mr.logger().Info("phase started", "phase", "map", "tasks", mr.NMap, "workers", workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			mapResults <- RunWorker(ctx, master.Addr, workerID, mr)
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+	close(mapResults)
+
+	// Check map task results
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for err := range mapResults {
+		if err != nil {
+			return nil, fmt.Errorf("map task error: %w", err)
+		}
+	}
+
+	var stats MasterStats
+	master.Stats(0, &stats)
+	var records RecordStats
+	for _, fileRecords := range stats.Records {
+		records = records.add(fileRecords)
+	}
+	mr.logger().Info("phase completed", "phase", "map", "read", records.Read, "counted", records.Counted, "skipped", records.Skipped)
+	if mr.WriteRejects {
+		if err := mergeRejects(mr); err != nil {
+			return nil, fmt.Errorf("rejects error: %w", err)
+		}
+	}
+
+	// Concurrent execution of reduce tasks
+	mr.logger().Info("phase started", "phase", "reduce", "tasks", mr.NReduce)
+	parallel := mr.MaxParallelReduce
+	if parallel <= 0 || parallel > mr.NReduce {
+		parallel = mr.NReduce
+	}
+	reduceSlots := make(chan struct{}, parallel)
+	for i := 0; i < mr.NReduce; i++ {
+		wg.Add(1)
+		go func(task int) {
+			defer wg.Done()
+			reduceSlots <- struct{}{}
+			defer func() { <-reduceSlots }()
+			defer func() {
+				if r := recover(); r != nil {
+					reduceResults <- reduceResult{task: task, err: taskPanicError("reduce", task, r)}
+				}
+			}()
+			counts, err := reducePartition(ctx, task, mr)
+			if err == nil {
+				for kind, keyCounts := range baseParts[task] {
+					for key, count := range keyCounts {
+						counts[kind][key] += count
+					}
+				}
+			}
+			if err == nil && writeOutput && !mr.MergeOutput {
+				err = writeReduceOutput(mr, task, counts)
+			}
+			reduceResults <- reduceResult{task, counts, taskError("reduce", task, err)}
+		}(i)
+	}
+	var reduceErr error
+	reduced := 0
+	totals := mr.newCounts()
+	for i := 0; i < mr.NReduce; i++ {
+		result := <-reduceResults
+		if result.err != nil {
+			if reduceErr == nil {
+				reduceErr = result.err
+			}
+			continue
+		}
+		for kind, counts := range result.counts {
+			for key, count := range counts {
+				totals[kind][key] += count
+			}
+		}
+		reduced++
+		var ok bool
+		master.CompleteReduceTask(result.task, &ok)
+		mr.progress("reduce", reduced, mr.NReduce)
+	}
+	wg.Wait()
+
+	// Check reduce task results
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if reduceErr != nil {
+		return nil, fmt.Errorf("reduce task error: %w", reduceErr)
+	}
+	mr.logger().Info("phase completed", "phase", "reduce")
+
+	if writeOutput && mr.MergeOutput {
+		for _, format := range mr.outputFormats() {
+			name, err := mergedOutputName(mr, format)
+			if err == nil {
+				err = writeOutputFile(mr, name, format, totals)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("merge error: %w", err)
+			}
+		}
+	}
+
+	if !mr.KeepIntermediate {
+		if err := CleanupIntermediate(mr); err != nil {
+			return nil, fmt.Errorf("cleanup error: %w", err)
+		}
+	}
+
+	var doneReply string
+	client, err := dialMaster(ctx, master.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing error: %w", err)
+	}
+	defer client.Close()
+	if err := client.Call("Master.Done", 0, &doneReply); err != nil {
+		return nil, fmt.Errorf("done error: %w", err)
+	}
+	master.Wait()
+	if useManifest {
+		if err := WriteManifest(mr.OutputDir, manifest); err != nil {
+			return nil, fmt.Errorf("manifest error: %w", err)
+		}
+		if mr.Incremental {
+			if err := writeTotals(mr, totals); err != nil {
+				return nil, fmt.Errorf("manifest error: %w", err)
+			}
+		}
+	}
+	result := newResult(mr, totals)
+	if writeOutput {
+		plan, err := PlanJob(mr)
+		if err != nil {
+			return nil, err
+		}
+		result.Outputs = plan.Outputs
+	}
+	result.Records = records
+	result.FileRecords = stats.Records
+	return result, nil
+}
+
+// newResult converts summed counts into a Result
+func newResult(mr *MapReduce, counts kindCounts) *Result {
+	result := &Result{
+		Diagnosis: counts["diagnosis"],
+		Treatment: counts["treatment"],
+	}
+	for _, field := range mr.groupByFields() {
+		if field != "Diagnosis" && field != "Treatment" {
+			if result.Fields == nil {
+				result.Fields = make(map[string]map[string]int)
+			}
+			result.Fields[field] = counts[fieldKind(field)]
+		}
+	}
+	if mr.GroupByAge {
+		result.AgeBrackets = groupCounts(counts["agebracket"])
+	}
+	if mr.CrossTab {
+		result.CrossTab = groupCounts(counts["crosstab"])
+	}
+	if mr.NameCollisions {
+		result.NameCollisions = nameCollisions(counts["nameids"])
+	}
+	if mr.IDConflicts {
+		result.IDConflicts = idConflicts(counts["idrecords"])
+	}
+	if mr.CountBySource {
+		result.Sources = counts["source"]
+	}
+	if mr.AgeStats {
+		result.AgeStats = ageSummaries(counts["agestats"])
+	}
+	return result
+}
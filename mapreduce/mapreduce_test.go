@@ -0,0 +1,1647 @@
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sampleEHR holds two flu records and one cold record
+const sampleEHR = "P001 John Smith 45 flu rest\nP002 Jane Doe 30 cold fluids\nP003 Bob Jones 70 flu antiviral\n"
+
+// writeInput writes content to name under dir and returns its path
+func writeInput(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestJob returns a single-partition job over files that writes to a
+// fresh directory, listens on a free port and discards its log
+func newTestJob(t *testing.T, files ...string) *MapReduce {
+	t.Helper()
+	return &MapReduce{
+		Files:     files,
+		NMap:      len(files),
+		NReduce:   1,
+		OutputDir: t.TempDir(),
+		Addr:      ":0",
+		Logger:    slog.New(slog.DiscardHandler),
+	}
+}
+
+// runJob runs mr with RunInMemory, failing the test on error
+func runJob(t *testing.T, mr *MapReduce) *Result {
+	t.Helper()
+	result, err := RunInMemory(context.Background(), mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMapTaskSkipsMalformedLines(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", "PatientID Name Age Diagnosis Treatment\n\n"+sampleEHR+"P004 short\n")
+	result := runJob(t, newTestJob(t, input))
+	if result.Records.Skipped != 3 || result.Records.Counted != 3 {
+		t.Errorf("Records = %+v, want 3 counted and 3 skipped", result.Records)
+	}
+	if result.Diagnosis["flu"] != 2 || result.Diagnosis["cold"] != 1 {
+		t.Errorf("Diagnosis = %v", result.Diagnosis)
+	}
+}
+
+func TestSameBasenameInputsDoNotCollide(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a/records.txt", sampleEHR)
+	b := writeInput(t, dir, "b/records.txt", "P004 Ann Lee 12 asthma inhaler\n")
+	mr := newTestJob(t, a, b)
+	mr.NReduce = 2
+	if intermediateName(mr, "diagnosis", a, 0, 0) == intermediateName(mr, "diagnosis", b, 1, 0) {
+		t.Fatal("intermediate names collide")
+	}
+	result := runJob(t, mr)
+	want := map[string]int{"flu": 2, "cold": 1, "asthma": 1}
+	if !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+// intermediateFiles returns the map-* files left in dir
+func intermediateFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "map-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestCleanupIntermediate(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR)
+	mr := newTestJob(t, input)
+	runJob(t, mr)
+	if files := intermediateFiles(t, mr.OutputDir); len(files) != 0 {
+		t.Errorf("intermediate files left after run: %v", files)
+	}
+
+	mr = newTestJob(t, input)
+	mr.KeepIntermediate = true
+	runJob(t, mr)
+	if files := intermediateFiles(t, mr.OutputDir); len(files) == 0 {
+		t.Error("intermediate files removed despite KeepIntermediate")
+	}
+}
+
+func TestDiscoverInputsExcludesGeneratedFiles(t *testing.T) {
+	dir := t.TempDir()
+	records := writeInput(t, dir, "records.txt", sampleEHR)
+	writeInput(t, dir, "reduce-out.txt", "flu 2\n")
+	writeInput(t, dir, "map-diagnosis-0-0.txt", "flu 2\n")
+	writeInput(t, dir, "notes.md", "not an input\n")
+
+	for _, input := range []string{dir, filepath.Join(dir, "*.txt")} {
+		files, err := DiscoverInputs(input, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, []string{records}) {
+			t.Errorf("DiscoverInputs(%q) = %v, want %v", input, files, []string{records})
+		}
+	}
+}
+
+func TestIsGeneratedFile(t *testing.T) {
+	mr := newTestJob(t, "records.txt")
+	mr.RunID = NewRunID()
+	mr.Compress = true
+	generated := []string{
+		intermediateName(mr, "diagnosis", "records.txt", 3, 1),
+		intermediateName(mr, "diagnosis", "records.txt", 3, 1) + checksumExt,
+		spillName(mr, "treatment", "records.txt", 0, 2),
+		combineName(mr, "diagnosis", 1, 0, 0),
+		rejectsName(mr),
+		"reduce-out-0.txt",
+		"reduce-out.json",
+		"rejects.txt",
+	}
+	for _, format := range []string{"text", "json", "csv"} {
+		name, _ := reduceOutputName(mr, 2, format)
+		merged, _ := mergedOutputName(mr, format)
+		generated = append(generated, name, merged)
+	}
+	for _, name := range generated {
+		if !isGeneratedFile(filepath.Base(name)) {
+			t.Errorf("isGeneratedFile(%q) = false, want true", filepath.Base(name))
+		}
+	}
+
+	// Inputs that merely share a prefix with generated files are kept
+	for _, name := range []string{"map-clinic.txt", "map-2023-01-05.txt", "rejects-2023.txt", "spill-report.txt", "combined.txt", "reduce-outcomes.txt"} {
+		if isGeneratedFile(name) {
+			t.Errorf("isGeneratedFile(%q) = true, want false", name)
+		}
+	}
+	dir := t.TempDir()
+	clinic := writeInput(t, dir, "map-clinic.txt", sampleEHR)
+	writeInput(t, dir, "reduce-out-0.txt", "flu 2\n")
+	if files, _ := DiscoverInputs(dir, false); !reflect.DeepEqual(files, []string{clinic}) {
+		t.Errorf("DiscoverInputs = %v, want %v", files, []string{clinic})
+	}
+}
+
+func TestReducePartitionsMatchSingleReducer(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 asthma inhaler\nP005 Tom Hall 55 diabetes insulin\nP006 Sue Park 61 cold rest\n")
+	merged := func(nReduce int) string {
+		mr := newTestJob(t, input)
+		mr.NReduce = nReduce
+		if _, err := Run(context.Background(), mr); err != nil {
+			t.Fatal(err)
+		}
+		var outputs []string
+		for task := 0; task < nReduce; task++ {
+			name, err := reduceOutputName(mr, task, "text")
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, name)
+		}
+		out := filepath.Join(mr.OutputDir, "union.txt")
+		if err := MergeOutputs(outputs, out); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if single, union := merged(1), merged(3); union != single {
+		t.Errorf("union of 3 partitions:\n%s\nsingle reducer:\n%s", union, single)
+	}
+}
+
+func TestGroupByAge(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt",
+		"P001 Amy Ray 5 flu rest\nP002 Ben Orr 17 flu rest\nP003 Cal Fox 18 flu rest\n"+
+			"P004 Dee Low 64 cold fluids\nP005 Eve Kim 65 flu antiviral\nP006 Fay Moe 90 cold rest\n")
+	mr := newTestJob(t, input)
+	mr.GroupByAge = true
+	want := map[string]map[string]int{
+		"0-17":  {"flu": 2},
+		"18-39": {"flu": 1},
+		"40-64": {"cold": 1},
+		"65+":   {"flu": 1, "cold": 1},
+	}
+	if got := runJob(t, mr).AgeBrackets; !reflect.DeepEqual(got, want) {
+		t.Errorf("AgeBrackets = %v, want %v", got, want)
+	}
+
+	mr = newTestJob(t, input)
+	mr.GroupByAge = true
+	mr.AgeBrackets = []AgeBracket{{Label: "young", Min: 0, Max: 39}, {Label: "old", Min: 40, Max: 200}}
+	want = map[string]map[string]int{
+		"young": {"flu": 3},
+		"old":   {"flu": 1, "cold": 2},
+	}
+	if got := runJob(t, mr).AgeBrackets; !reflect.DeepEqual(got, want) {
+		t.Errorf("custom AgeBrackets = %v, want %v", got, want)
+	}
+}
+
+func TestCombinerSpills(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 asthma inhaler\nP005 Tom Hall 55 diabetes insulin\nP006 Sue Park 61 cold rest\n")
+	want := runJob(t, newTestJob(t, input))
+
+	mr := newTestJob(t, input)
+	// Each record adds at least one new key, so a threshold of 2 spills
+	// every couple of records
+	mr.CombinerThreshold = 2
+	mr.KeepIntermediate = true
+	got := runJob(t, mr)
+	if !reflect.DeepEqual(got.Diagnosis, want.Diagnosis) || !reflect.DeepEqual(got.Treatment, want.Treatment) {
+		t.Errorf("with spills got %v %v, want %v %v", got.Diagnosis, got.Treatment, want.Diagnosis, want.Treatment)
+	}
+	spills, err := filepath.Glob(filepath.Join(mr.OutputDir, "spill-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spills) != 0 {
+		t.Errorf("spill files left after merge: %v", spills)
+	}
+}
+
+// gzipped returns content compressed with gzip
+func gzipped(t *testing.T, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGzipInput(t *testing.T) {
+	dir := t.TempDir()
+	want := runJob(t, newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR)))
+	got := runJob(t, newTestJob(t, writeInput(t, dir, "b.txt.gz", gzipped(t, sampleEHR))))
+	if !reflect.DeepEqual(got.Diagnosis, want.Diagnosis) || !reflect.DeepEqual(got.Treatment, want.Treatment) {
+		t.Errorf("gzip input got %v %v, want %v %v", got.Diagnosis, got.Treatment, want.Diagnosis, want.Treatment)
+	}
+
+	files, err := DiscoverInputs(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("DiscoverInputs = %v, want the .txt and .txt.gz inputs", files)
+	}
+}
+
+func TestRunReturnsMapError(t *testing.T) {
+	mr := newTestJob(t, filepath.Join(t.TempDir(), "missing.txt"))
+	_, err := Run(context.Background(), mr)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Run = %v, want a file not found error", err)
+	}
+
+	// Without a manifest to build the missing file is first opened by its
+	// map task
+	_, err = RunInMemory(context.Background(), mr)
+	var taskErr *TaskError
+	if !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &taskErr) || taskErr.Phase != "map" {
+		t.Errorf("RunInMemory = %v, want a map TaskError for the missing file", err)
+	}
+}
+
+// endlessRecords reads the same EHR record forever, calling cancel once it
+// has been read from reads times
+type endlessRecords struct {
+	reads  int
+	cancel context.CancelFunc
+}
+
+func (r *endlessRecords) Read(p []byte) (int, error) {
+	if r.reads--; r.reads == 0 {
+		r.cancel()
+	}
+	const record = "P001 John Smith 45 flu rest\n"
+	n := 0
+	for n+len(record) <= len(p) {
+		n += copy(p[n:], record)
+	}
+	return n, nil
+}
+
+func TestCancelMidMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := newTestJob(t)
+	mr.InputReaders = []io.Reader{&endlessRecords{reads: 3, cancel: cancel}}
+	start := time.Now()
+	_, err := RunInMemory(ctx, mr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunInMemory = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunInMemory took %v to return after cancellation", elapsed)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P001 John Smith 45 flu rest\nP001 John Smith 45 cold fluids\nP002 Jane Doe 30 cold fluids\n")
+	mr := newTestJob(t, input)
+	mr.Dedup = true
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Dedup Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if result.Records.Read != 6 || result.Records.Counted != 3 {
+		t.Errorf("Dedup Records = %+v, want 6 read and 3 counted", result.Records)
+	}
+
+	mr = newTestJob(t, input)
+	mr.Dedup = true
+	mr.DedupByDiagnosis = true
+	if got, want := runJob(t, mr).Diagnosis, map[string]int{"flu": 2, "cold": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DedupByDiagnosis Diagnosis = %v, want %v", got, want)
+	}
+}
+
+func TestValidateAge(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee abc flu rest\nP005 Tom Hall -5 flu rest\nP006 Sue Park 151 flu rest\nP007 Baby Ray 0 cold rest\n")
+	mr := newTestJob(t, input)
+	mr.ValidateAge = true
+	result := runJob(t, mr)
+	if result.Records.Skipped != 3 || result.Records.Counted != 4 {
+		t.Errorf("Records = %+v, want 4 counted and 3 skipped", result.Records)
+	}
+	if want := map[string]int{"flu": 2, "cold": 2}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt",
+		"P001 John Smith 45 Flu Rest\nP002 Jane Doe 30 flu rest\nP003 Bob Jones 70 FLU REST\n")
+	mr := newTestJob(t, input)
+	mr.CaseInsensitive = true
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 3}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if want := map[string]int{"rest": 3}; !reflect.DeepEqual(result.Treatment, want) {
+		t.Errorf("Treatment = %v, want %v", result.Treatment, want)
+	}
+	if got := runJob(t, newTestJob(t, input)).Diagnosis; len(got) != 3 {
+		t.Errorf("case-sensitive Diagnosis = %v, want three spellings", got)
+	}
+}
+
+func TestNormalizeOnlyTreatment(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt",
+		"P001 John Smith 45 Flu Rest\nP002 Jane Doe 30 flu  REST\n"))
+	mr.NormalizeFields = []string{"Treatment"}
+	result := runJob(t, mr)
+	if want := map[string]int{"Flu": 1, "flu": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want its casing preserved", result.Diagnosis)
+	}
+	if want := map[string]int{"rest": 2}; !reflect.DeepEqual(result.Treatment, want) {
+		t.Errorf("Treatment = %v, want %v", result.Treatment, want)
+	}
+
+	mr = newTestJob(t, mr.Files...)
+	mr.NormalizeFields = []string{"Ward"}
+	if _, err := RunInMemory(context.Background(), mr); err == nil || !strings.Contains(err.Error(), "unknown normalize field") {
+		t.Errorf("RunInMemory with an unknown field = %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.Filter = func(ehr EHR) bool { return ehr.Diagnosis == "flu" }
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if _, ok := result.Treatment["fluids"]; ok {
+		t.Errorf("Treatment = %v includes the filtered cold record", result.Treatment)
+	}
+}
+
+func TestSplitFileIntoChunks(t *testing.T) {
+	var records strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&records, "P%03d Ann Lee %d flu rest\n", i, 20+i)
+	}
+	input := writeInput(t, t.TempDir(), "a.txt", records.String())
+	size := int64(records.Len())
+	splits, err := SplitFile(input, size/4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(splits) != 4 {
+		t.Fatalf("SplitFile gave %d chunks, want 4", len(splits))
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var union strings.Builder
+	for _, split := range splits {
+		chunk := data[split.Offset : split.Offset+split.Length]
+		if len(chunk) == 0 || chunk[len(chunk)-1] != '\n' {
+			t.Errorf("chunk at %d does not end on a line break", split.Offset)
+		}
+		union.Write(chunk)
+	}
+	if union.String() != records.String() {
+		t.Error("chunks do not add up to the whole file")
+	}
+
+	mr := newTestJob(t, input)
+	mr.SplitSize = size / 4
+	result := runJob(t, mr)
+	if mr.NMap != 4 || result.Records.Counted != 40 || result.Diagnosis["flu"] != 40 {
+		t.Errorf("split job: %d map tasks, Records %+v, Diagnosis %v", mr.NMap, result.Records, result.Diagnosis)
+	}
+}
+
+func TestConcurrentChunksAtBoundaries(t *testing.T) {
+	// Varying line lengths put the chunk edges mid-line
+	var records strings.Builder
+	const n = 200
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&records, "P%04d %s Lee %d flu %s\n", i, strings.Repeat("A", 1+i%7), i%90, strings.Repeat("r", 1+i%11))
+	}
+	input := writeInput(t, t.TempDir(), "big.txt", records.String())
+	mr := newTestJob(t, input)
+	mr.SplitSize = int64(records.Len()) / 4
+	mr.GroupByFields = []string{"PatientID"}
+	var c concurrency
+	mr.Filter = func(EHR) bool {
+		c.enter()
+		defer c.leave()
+		time.Sleep(time.Millisecond)
+		return true
+	}
+	result := runJob(t, mr)
+	if mr.NMap != 4 {
+		t.Fatalf("%d map tasks, want 4 chunks", mr.NMap)
+	}
+	if c.max < 2 {
+		t.Errorf("at most %d chunk ran at once, want them mapped concurrently", c.max)
+	}
+	ids := result.Fields["PatientID"]
+	if len(ids) != n || result.Records.Counted != n {
+		t.Errorf("%d distinct records, %d counted, want %d", len(ids), result.Records.Counted, n)
+	}
+	for id, count := range ids {
+		if count != 1 {
+			t.Errorf("record %s counted %d times", id, count)
+		}
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.DryRun = true
+	result, err := Run(context.Background(), mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(mr.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dry run wrote %d files to the output directory", len(entries))
+	}
+
+	plan := result.Plan
+	if plan == nil {
+		t.Fatal("dry run returned no plan")
+	}
+	if plan.MapTasks != 1 || plan.ReduceTasks != 1 || len(plan.Outputs) != 1 {
+		t.Errorf("plan = %+v", plan)
+	}
+	if result.Records.Read != 0 || result.Diagnosis != nil {
+		t.Errorf("dry run counted records: %+v", result)
+	}
+}
+
+func TestCrossTab(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 flu rest\nP005 Tom Hall 55 cold rest\n"))
+	mr.CrossTab = true
+	want := map[string]map[string]int{
+		"flu":  {"rest": 2, "antiviral": 1},
+		"cold": {"fluids": 1, "rest": 1},
+	}
+	if got := runJob(t, mr).CrossTab; !reflect.DeepEqual(got, want) {
+		t.Errorf("CrossTab = %v, want %v", got, want)
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR), writeInput(t, dir, "b.txt", sampleEHR))
+	mr.NReduce = 3
+	var mu sync.Mutex
+	last := make(map[string][2]int)
+	calls := 0
+	mr.OnProgress = func(phase string, done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		last[phase] = [2]int{done, total}
+	}
+	runJob(t, mr)
+	if want := map[string][2]int{"map": {2, 2}, "reduce": {3, 3}}; !reflect.DeepEqual(last, want) {
+		t.Errorf("last progress = %v, want %v", last, want)
+	}
+	if calls != 5 {
+		t.Errorf("OnProgress called %d times, want once per task", calls)
+	}
+}
+
+func TestOnBytesProgress(t *testing.T) {
+	var data bytes.Buffer
+	if err := GenerateEHR(&data, 100000, 1); err != nil {
+		t.Fatal(err)
+	}
+	input := writeInput(t, t.TempDir(), "a.txt", data.String())
+	size := int64(data.Len())
+	for _, splitSize := range []int64{0, size / 2} {
+		mr := newTestJob(t, input)
+		mr.SplitSize = splitSize
+		var mu sync.Mutex
+		var reads []int64
+		var consumed int64
+		ends := 0
+		mr.OnBytesProgress = func(filename string, read, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			reads = append(reads, read)
+			if read == total {
+				consumed += total
+				ends++
+			}
+		}
+		runJob(t, mr)
+		if ends != mr.NMap || consumed != size {
+			t.Errorf("SplitSize %d: %d of %d tasks finished at %d bytes, want the file's %d", splitSize, ends, mr.NMap, consumed, size)
+		}
+		if splitSize == 0 && (len(reads) < 2 || !slices.IsSorted(reads)) {
+			t.Errorf("progress reported %v, want increasing updates before the end of a %d byte file", reads, size)
+		}
+	}
+}
+
+func TestRunInMemory(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.NReduce = 2
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if want := map[string]int{"rest": 1, "fluids": 1, "antiviral": 1}; !reflect.DeepEqual(result.Treatment, want) {
+		t.Errorf("Treatment = %v, want %v", result.Treatment, want)
+	}
+	outputs, err := filepath.Glob(filepath.Join(mr.OutputDir, "reduce-out*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 0 || len(result.Outputs) != 0 {
+		t.Errorf("RunInMemory wrote output files %v", outputs)
+	}
+}
+
+func TestWriteIntermediateRoundTrip(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1, OutputDir: t.TempDir()}
+	counts := map[string]int{"flu": 3, "cold": 1, "flu, mild": 2, "a \"quoted\" key": 4}
+	for i := 0; i < 5000; i++ {
+		counts[fmt.Sprintf("key-%d", i)] = i
+	}
+	if err := writeIntermediate(mr, "diagnosis", "a.txt", 0, counts); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	if err := readCounts(mr, intermediateName(mr, "diagnosis", "a.txt", 0, 0), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, counts) {
+		t.Errorf("read back %d keys, want %d", len(got), len(counts))
+	}
+}
+
+func TestGobIntermediate(t *testing.T) {
+	counts := map[string]int{"flu": 3, "cold": 1, "flu, mild": 2, "a \"quoted\" key": 4, "": 5}
+	for _, compress := range []bool{false, true} {
+		mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1, OutputDir: t.TempDir(), IntermediateFormat: "gob", Compress: compress}
+		if err := writeIntermediate(mr, "diagnosis", "a.txt", 0, counts); err != nil {
+			t.Fatal(err)
+		}
+		name := intermediateName(mr, "diagnosis", "a.txt", 0, 0)
+		if !strings.Contains(name, ".gob") {
+			t.Errorf("gob intermediate named %s", name)
+		}
+		got := make(map[string]int)
+		if err := readCounts(mr, name, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, counts) {
+			t.Errorf("Compress %v: read back %v, want %v", compress, got, counts)
+		}
+	}
+
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 5; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%d.txt", i),
+			fmt.Sprintf("%sP1%02d Ann Lee 12 d%d rest\n", sampleEHR, i, i%3)))
+	}
+	job := func(format string) *MapReduce {
+		mr := newTestJob(t, files...)
+		mr.NReduce = 2
+		mr.IntermediateFormat = format
+		mr.CombinerThreshold = 2
+		mr.MaxReduceMemory = 2 * mergeBufferBytes
+		mr.Checksums = true
+		return mr
+	}
+	want, got := runJob(t, job("text")), runJob(t, job("gob"))
+	if !reflect.DeepEqual(got.Diagnosis, want.Diagnosis) || !reflect.DeepEqual(got.Treatment, want.Treatment) {
+		t.Errorf("gob job %v %v, want %v %v", got.Diagnosis, got.Treatment, want.Diagnosis, want.Treatment)
+	}
+
+	if _, err := RunInMemory(context.Background(), job("protobuf")); err == nil {
+		t.Error("RunInMemory accepted an unknown intermediate format")
+	}
+}
+
+func TestManyMapTasks(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 500; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%03d.txt", i), sampleEHR))
+	}
+	mr := newTestJob(t, files...)
+	mr.Workers = 8
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 1000, "cold": 500}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR)
+	cwd := t.TempDir()
+	t.Chdir(cwd)
+	mr := newTestJob(t, input)
+	mr.OutputDir = filepath.Join(t.TempDir(), "scratch", "out")
+	if _, err := Run(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(cwd); len(entries) != 0 {
+		t.Errorf("%d files written to the working directory", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(mr.OutputDir, "reduce-out-0.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCombinerFanIn(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 9; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%d.txt", i),
+			fmt.Sprintf("%sP1%02d Ann Lee 12 d%d rest\n", sampleEHR, i, i%4)))
+	}
+	plain := newTestJob(t, files...)
+	plain.NReduce = 2
+	want := runJob(t, plain)
+
+	combined := newTestJob(t, files...)
+	combined.NReduce = 2
+	combined.CombinerFanIn = 2
+	got := runJob(t, combined)
+	if !reflect.DeepEqual(got.Diagnosis, want.Diagnosis) || !reflect.DeepEqual(got.Treatment, want.Treatment) {
+		t.Errorf("combined %v %v, want %v %v", got.Diagnosis, got.Treatment, want.Diagnosis, want.Treatment)
+	}
+}
+
+// cancelSink is an OutputSink writer that cancels a job on its first write
+type cancelSink struct{ cancel context.CancelFunc }
+
+func (c cancelSink) Write(p []byte) (int, error) {
+	c.cancel()
+	return len(p), nil
+}
+
+func (c cancelSink) Close() error { return nil }
+
+func TestMaxReduceMemory(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 9; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%d.txt", i),
+			fmt.Sprintf("%sP1%02d Ann Lee 12 d%d rest\n", sampleEHR, i, i%4)))
+	}
+	reduce := func(ctx context.Context, mr *MapReduce) error {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		results := make(chan error, 1)
+		ReduceTask(ctx, 0, mr, &wg, results)
+		return <-results
+	}
+	job := func(maxMemory int) *MapReduce {
+		mr := newTestJob(t, files...)
+		mr.OutputFormats = []string{"text", "csv"}
+		mr.CountBySource = true
+		mr.MaxReduceMemory = maxMemory
+		mapAll(t, mr)
+		return mr
+	}
+	plain := job(0)
+	if err := reduce(context.Background(), plain); err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two merge buffers forces a k-way merge of two files at a time
+	mr := job(2 * mergeBufferBytes)
+	if !mr.streamsReduceOutput() {
+		t.Fatal("job does not stream its reduce output")
+	}
+	if err := reduce(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range mr.OutputFormats {
+		wantName, _ := reduceOutputName(plain, 0, format)
+		gotName, _ := reduceOutputName(mr, 0, format)
+		want, err := os.ReadFile(wantName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(gotName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("streamed %s output:\n%s\nwant:\n%s", format, got, want)
+		}
+	}
+	merged, err := filepath.Glob(filepath.Join(mr.OutputDir, "combine-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) == 0 {
+		t.Error("no external merge ran")
+	}
+
+	// The output is written while the merge still reads, so a cancel on the
+	// first write stops it; summing the partition first would finish
+	var records strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&records, "P%04d Ann Lee 12 d%04d rest\n", i, i)
+	}
+	for _, maxMemory := range []int{0, 2 * mergeBufferBytes} {
+		mr := newTestJob(t, writeInput(t, t.TempDir(), "many.txt", records.String()))
+		mr.MaxReduceMemory = maxMemory
+		mapAll(t, mr)
+		ctx, cancel := context.WithCancel(context.Background())
+		mr.OutputSink = func(string) (io.WriteCloser, error) { return cancelSink{cancel}, nil }
+		err := reduce(ctx, mr)
+		if streamed := errors.Is(err, context.Canceled); streamed != (maxMemory > 0) {
+			t.Errorf("MaxReduceMemory %d: ReduceTask = %v, streamed %v", maxMemory, err, streamed)
+		}
+		cancel()
+	}
+}
+
+func TestMergeMissingIntermediate(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 3; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%d.txt", i), fmt.Sprintf("P00%d Ann Lee 12 d%d rest\n", i, i)))
+	}
+	mr := newTestJob(t, files...)
+	mr.MaxReduceMemory = 2 * mergeBufferBytes
+	mr.Checksums = true
+	mr.SkipMissingIntermediate = true
+	mr.Logger = slog.New(&captureHandler{})
+	mapAll(t, mr)
+
+	// A missing checksum sidecar is an error even when missing files are skipped
+	sidecar := intermediateName(mr, "diagnosis", files[1], 1, 0) + checksumExt
+	if err := os.Remove(sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reducePartition(context.Background(), 0, mr); err == nil {
+		t.Error("reducePartition skipped a file whose checksum sidecar is missing")
+	}
+
+	if err := os.Remove(strings.TrimSuffix(sidecar, checksumExt)); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := reducePartition(context.Background(), 0, mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"d0": 1, "d2": 1}; !reflect.DeepEqual(counts["diagnosis"], want) {
+		t.Errorf("diagnosis = %v, want %v", counts["diagnosis"], want)
+	}
+}
+
+func TestMergeReadErrorNamesFile(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t)
+	mr.SkipMissingIntermediate = true
+	mr.Logger = slog.New(&captureHandler{})
+	good := writeInput(t, dir, "good.txt", "\"a\" 1\n\"b\" 1\n")
+	bad := writeInput(t, dir, "bad.txt", "\"a\" 1\n\"b\" x\n")
+
+	// The skipped first input must not shift the name reported for bad
+	inputs := []string{filepath.Join(dir, "missing.txt"), good, bad}
+	err := mergeSortedCounts(context.Background(), mr, inputs, filepath.Join(dir, "out.txt"))
+	var ioErr *IOError
+	if !errors.As(err, &ioErr) || ioErr.Path != bad {
+		t.Errorf("mergeSortedCounts = %v, want an *IOError reading %s", err, bad)
+	}
+}
+
+// sliceStream is a sortedStream over keys held in memory
+type sliceStream struct{ keys []string }
+
+func (s *sliceStream) peek() (string, bool) {
+	if len(s.keys) == 0 {
+		return "", false
+	}
+	return s.keys[0], true
+}
+
+func TestMergeByKey(t *testing.T) {
+	streams := []*sliceStream{{[]string{"a", "c", "c"}}, {}, {[]string{"b", "c"}}}
+	var got []string
+	taken := 0
+	err := mergeByKey(context.Background(), streams, func(s *sliceStream) error {
+		s.keys = s.keys[1:]
+		taken++
+		return nil
+	}, func(key string) error {
+		got = append(got, fmt.Sprintf("%s%d", key, taken))
+		taken = 0
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a1", "b1", "c3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mergeByKey(ctx, streams, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("mergeByKey = %v, want context.Canceled", err)
+	}
+}
+
+func TestEmptyInputDir(t *testing.T) {
+	files, err := DiscoverInputs(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := newTestJob(t, files...)
+	if _, err := Run(context.Background(), mr); !errors.Is(err, ErrNoInput) {
+		t.Fatalf("Run = %v, want ErrNoInput", err)
+	}
+	if entries, _ := os.ReadDir(mr.OutputDir); len(entries) != 0 {
+		t.Errorf("Run wrote %d files without input", len(entries))
+	}
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "patients.txt", "P001 John Smith 45 flu rest\nP002 Jane Doe 30 cold fluids\nP003 bad line\n")
+	mr := newTestJob(t, input)
+	var log bytes.Buffer
+	mr.Logger = slog.New(slog.NewTextHandler(&log, nil))
+	runJob(t, mr)
+	if !strings.Contains(log.String(), "file="+input+" line=3 ") {
+		t.Errorf("log does not locate the bad record at line 3:\n%s", log.String())
+	}
+
+	err := &ParseError{File: "patients.txt", Line: 42, Err: errors.New("expected 6 fields, got 4")}
+	if got, want := err.Error(), "patients.txt:42: expected 6 fields, got 4"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestIOError(t *testing.T) {
+	// A directory opens like a file but fails on the first read
+	mr := newTestJob(t, t.TempDir())
+	_, err := RunInMemory(context.Background(), mr)
+	var ioErr *IOError
+	if !errors.As(err, &ioErr) || ioErr.Op != "read" || ioErr.Path != mr.Files[0] {
+		t.Errorf("RunInMemory on a directory = %v, want an *IOError reading it", err)
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		t.Errorf("read failure %v matches *ParseError", err)
+	}
+}
+
+func TestSkipHeader(t *testing.T) {
+	// The header parses as a record, so only SkipHeader keeps it out
+	const header = "PatientID First Last Age Diagnosis Treatment\n"
+	dir := t.TempDir()
+	files := []string{writeInput(t, dir, "a.txt", header+sampleEHR), writeInput(t, dir, "b.txt", header+sampleEHR)}
+	if got := runJob(t, newTestJob(t, files...)).Diagnosis["Diagnosis"]; got != 2 {
+		t.Fatalf("without SkipHeader the headers counted %d times, want 2", got)
+	}
+
+	mr := newTestJob(t, files...)
+	mr.SkipHeader = true
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 4, "cold": 2}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if result.Records.Counted != 6 {
+		t.Errorf("Records = %+v, want 6 counted", result.Records)
+	}
+}
+
+func TestGroupByFields(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+"P004 Ann Lee 45 cold rest\n"))
+	mr.GroupByFields = []string{"Age", "Diagnosis"}
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 2}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if want := map[string]int{"45": 2, "30": 1, "70": 1}; !reflect.DeepEqual(result.Fields["Age"], want) {
+		t.Errorf("Fields[Age] = %v, want %v", result.Fields["Age"], want)
+	}
+	if len(result.Treatment) != 0 {
+		t.Errorf("Treatment = %v, want it not counted", result.Treatment)
+	}
+}
+
+// captureHandler records the message of every log event at any level
+type captureHandler struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, r.Message)
+	return nil
+}
+
+func TestStructuredLogging(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+"P004 short\n"))
+	handler := &captureHandler{}
+	mr.Logger = slog.New(handler)
+	runJob(t, mr)
+	for _, want := range []string{
+		"phase started", "map task assigned", "record skipped", "map task completed",
+		"phase completed", "reduce task completed",
+	} {
+		found := false
+		for _, msg := range handler.messages {
+			found = found || msg == want
+		}
+		if !found {
+			t.Errorf("no %q event in %q", want, handler.messages)
+		}
+	}
+}
+
+func TestRecordStatsPerFile(t *testing.T) {
+	dir := t.TempDir()
+	good := writeInput(t, dir, "good.txt", sampleEHR)
+	mixed := writeInput(t, dir, "mixed.txt", "P004 short\n"+sampleEHR+"\nP005 also short\n")
+	mr := newTestJob(t, good, mixed)
+
+	// Run reports the summary in its Result and leaves standard output alone
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	result, err := Run(context.Background(), mr)
+	os.Stdout = stdout
+	w.Close()
+	printed, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) != 0 {
+		t.Errorf("Run printed %q", printed)
+	}
+
+	if want := (RecordStats{Read: 9, Counted: 6, Skipped: 3}); result.Records != want {
+		t.Errorf("Records = %+v, want %+v", result.Records, want)
+	}
+	want := map[string]RecordStats{
+		good:  {Read: 3, Counted: 3},
+		mixed: {Read: 6, Counted: 3, Skipped: 3},
+	}
+	if !reflect.DeepEqual(result.FileRecords, want) {
+		t.Errorf("FileRecords = %+v, want %+v", result.FileRecords, want)
+	}
+}
+
+func TestTSVInput(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.tsv",
+		"P001\tJohn Smith\t45\tchest pain\tbed rest\nP002\tJane Doe\t30\tchest pain\tfluids\nP003\tBob Jones\t70\tflu\tbed rest\n"))
+	mr.Parser = TSVParser{}
+	result := runJob(t, mr)
+	if want := map[string]int{"chest pain": 2, "flu": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if want := map[string]int{"bed rest": 2, "fluids": 1}; !reflect.DeepEqual(result.Treatment, want) {
+		t.Errorf("Treatment = %v, want %v", result.Treatment, want)
+	}
+}
+
+func TestManifestSkipsUnchangedRerun(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR)
+	mr := newTestJob(t, input)
+	rerun := func() *Result {
+		t.Helper()
+		result, err := Run(context.Background(), mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if rerun().UpToDate {
+		t.Fatal("first run skipped")
+	}
+	if result := rerun(); !result.UpToDate || result.Records.Read != 0 {
+		t.Errorf("unchanged rerun = %+v, want it skipped", result)
+	}
+
+	mr.Force = true
+	if rerun().UpToDate {
+		t.Error("forced rerun skipped")
+	}
+	mr.Force = false
+
+	writeInput(t, filepath.Dir(input), "a.txt", sampleEHR+"P004 Ann Lee 12 asthma inhaler\n")
+	result := rerun()
+	if result.UpToDate || result.Diagnosis["asthma"] != 1 {
+		t.Errorf("rerun after the input changed = %+v", result)
+	}
+}
+
+func TestIncrementalMapsOnlyNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", sampleEHR)
+	mr := newTestJob(t, a)
+	mr.Incremental = true
+	if _, err := Run(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+
+	b := writeInput(t, dir, "b.txt", "P004 Ann Lee 12 asthma inhaler\nP005 Tom Hill 50 flu rest\n")
+	mr.Files, mr.NMap = []string{a, b}, 2
+	result, err := Run(context.Background(), mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Records.Read != 2 {
+		t.Errorf("second run read %d records, want only the new file's 2", result.Records.Read)
+	}
+	if want := map[string]int{"flu": 3, "cold": 1, "asthma": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	data, err := os.ReadFile(filepath.Join(mr.OutputDir, "reduce-out-0.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "flu 3") {
+		t.Errorf("reduce output does not hold the merged counts:\n%s", data)
+	}
+}
+
+func TestInputReaders(t *testing.T) {
+	mr := newTestJob(t)
+	mr.NReduce = 2
+	mr.InputReaders = []io.Reader{strings.NewReader(sampleEHR), strings.NewReader("P004 Ann Lee 12 asthma inhaler\n")}
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 1, "asthma": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if mr.NMap != 2 || result.Sources != nil {
+		t.Errorf("NMap = %d, Sources = %v", mr.NMap, result.Sources)
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 NA rest\nP005 Tom Hall 55 - rest\nP006 Sue Park 61 \"\" rest\nP007 Kim Oh 20 flu -\n")
+	mr := newTestJob(t, input)
+	mr.MissingValues = []string{"NA", "-", ""}
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 3, "cold": 1, "unknown": 3}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if result.Treatment["unknown"] != 1 {
+		t.Errorf("Treatment = %v, want one unknown", result.Treatment)
+	}
+
+	mr = newTestJob(t, input)
+	mr.MissingValues = []string{"NA", "-", ""}
+	mr.ExcludeMissing = true
+	result = runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("ExcludeMissing Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+// concurrency tracks how many holders are active at once
+type concurrency struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (c *concurrency) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active++
+	c.max = max(c.max, c.active)
+}
+
+func (c *concurrency) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+}
+
+// trackedOutput is a reduce output that holds its place in a concurrency
+// until closed
+type trackedOutput struct {
+	io.Writer
+	c *concurrency
+}
+
+func (o trackedOutput) Close() error {
+	// Hold the slot long enough for other reduce tasks to overlap
+	time.Sleep(20 * time.Millisecond)
+	o.c.leave()
+	return nil
+}
+
+func TestMaxParallelReduce(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 asthma inhaler\nP005 Tom Hall 55 diabetes insulin\nP006 Sue Park 61 cold rest\n")
+	want := runJob(t, newTestJob(t, input))
+
+	mr := newTestJob(t, input)
+	mr.NReduce = 4
+	mr.MaxParallelReduce = 2
+	var c concurrency
+	var mu sync.Mutex
+	var outputs []*bytes.Buffer
+	mr.OutputSink = func(name string) (io.WriteCloser, error) {
+		c.enter()
+		mu.Lock()
+		defer mu.Unlock()
+		outputs = append(outputs, &bytes.Buffer{})
+		return trackedOutput{Writer: outputs[len(outputs)-1], c: &c}, nil
+	}
+	result, err := Run(context.Background(), mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Diagnosis, want.Diagnosis) || !reflect.DeepEqual(result.Treatment, want.Treatment) {
+		t.Errorf("counts %v %v, want %v %v", result.Diagnosis, result.Treatment, want.Diagnosis, want.Treatment)
+	}
+	if len(outputs) != 4 {
+		t.Errorf("%d reduce outputs written, want 4", len(outputs))
+	}
+	if c.max > 2 {
+		t.Errorf("%d reduce tasks ran at once, want at most 2", c.max)
+	}
+}
+
+// trackedInput reads records while holding its place in a concurrency
+// from the first Read until EOF
+type trackedInput struct {
+	r       io.Reader
+	c       *concurrency
+	started bool
+}
+
+func (in *trackedInput) Read(p []byte) (int, error) {
+	if !in.started {
+		in.started = true
+		in.c.enter()
+		// Stay busy long enough for other map tasks to overlap
+		time.Sleep(10 * time.Millisecond)
+	}
+	n, err := in.r.Read(p)
+	if err == io.EOF {
+		in.c.leave()
+	}
+	return n, err
+}
+
+func TestMaxParallelMap(t *testing.T) {
+	var c concurrency
+	mr := newTestJob(t)
+	mr.Workers = 10
+	mr.MaxParallelMap = 3
+	for i := 0; i < 20; i++ {
+		mr.InputReaders = append(mr.InputReaders, &trackedInput{r: strings.NewReader(sampleEHR), c: &c})
+	}
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 40, "cold": 20}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if c.max > 3 || c.max == 0 {
+		t.Errorf("%d map tasks ran at once, want at most 3", c.max)
+	}
+}
+
+// slowRecords reads one EHR record every 10ms, forever
+type slowRecords struct{}
+
+func (slowRecords) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return copy(p, "P001 John Smith 45 flu rest\n"), nil
+}
+
+func TestJobTimeout(t *testing.T) {
+	mr := newTestJob(t)
+	mr.InputReaders = []io.Reader{slowRecords{}}
+	mr.JobTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := RunInMemory(context.Background(), mr)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "job exceeded timeout of 50ms") {
+		t.Fatalf("RunInMemory = %v, want the job timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunInMemory took %v to time out", elapsed)
+	}
+}
+
+func TestPatientIDPattern(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"X9 Ann Lee 12 asthma inhaler\nP0005 Tom Hall 55 flu rest\np006 Sue Park 61 cold rest\n"))
+	mr.PatientIDPattern = regexp.MustCompile(`^P[0-9]{3}$`)
+	mr.WriteRejects = true
+	result := runJob(t, mr)
+	if result.Records.Counted != 3 || result.Records.Skipped != 3 {
+		t.Errorf("Records = %+v, want 3 counted and 3 skipped", result.Records)
+	}
+	if result.Diagnosis["asthma"] != 0 {
+		t.Errorf("Diagnosis = %v includes a rejected record", result.Diagnosis)
+	}
+	rejects, err := os.ReadFile(filepath.Join(mr.OutputDir, "rejects.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"X9", "P0005", "p006"} {
+		if !strings.Contains(string(rejects), id+" ") {
+			t.Errorf("rejects.txt does not list %s:\n%s", id, rejects)
+		}
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", "\uFEFF"+sampleEHR))
+	mr.PatientIDPattern = regexp.MustCompile(`^P[0-9]{3}$`)
+	result := runJob(t, mr)
+	if result.Records.Counted != 3 || result.Records.Skipped != 0 {
+		t.Errorf("Records = %+v, want the first record's PatientID free of the BOM", result.Records)
+	}
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P009 John Smith 60 cold rest\nP001 John Smith 45 cold rest\n"))
+	mr.NameCollisions = true
+	want := map[string][]string{"John Smith": {"P001", "P009"}}
+	if got := runJob(t, mr).NameCollisions; !reflect.DeepEqual(got, want) {
+		t.Errorf("NameCollisions = %v, want %v", got, want)
+	}
+}
+
+func TestIDConflicts(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR),
+		writeInput(t, dir, "b.txt", "P001 John Smith 46 flu rest\nP002 Jane Doe 30 cold fluids\n"))
+	mr.IDConflicts = true
+	want := map[string][]RecordVariant{"P001": {
+		{Name: "John Smith", Age: "45", Diagnosis: "flu", Count: 1},
+		{Name: "John Smith", Age: "46", Diagnosis: "flu", Count: 1},
+	}}
+	if got := runJob(t, mr).IDConflicts; !reflect.DeepEqual(got, want) {
+		t.Errorf("IDConflicts = %v, want %v", got, want)
+	}
+}
+
+func TestTreatmentCategories(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", "P001 John Smith 45 flu ibuprofen\n"+
+		"P002 Jane Doe 30 cold aspirin\nP003 Bob Jones 70 flu antiviral\n")
+	categories := map[string]string{"ibuprofen": "analgesics", "aspirin": "analgesics"}
+	for _, test := range []struct {
+		unmapped string
+		want     map[string]int
+	}{
+		{"", map[string]int{"analgesics": 2, "antiviral": 1}},
+		{"other", map[string]int{"analgesics": 2, "other": 1}},
+	} {
+		mr := newTestJob(t, input)
+		mr.TreatmentCategories = categories
+		mr.UnmappedTreatment = test.unmapped
+		if got := runJob(t, mr).Treatment; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("UnmappedTreatment %q: Treatment = %v, want %v", test.unmapped, got, test.want)
+		}
+	}
+}
+
+// mapAll runs the map task for each of mr.Files, leaving their intermediate
+// files for a test to reduce
+func mapAll(t testing.TB, mr *MapReduce) {
+	t.Helper()
+	for task := range mr.Files {
+		mapOne(t, mr, task)
+	}
+}
+
+// mapOne runs a single map task and returns its record counts
+func mapOne(t testing.TB, mr *MapReduce, task int) RecordStats {
+	t.Helper()
+	var wg sync.WaitGroup
+	results := make(chan MapResult, 1)
+	wg.Add(1)
+	MapTask(context.Background(), mr.Files[task], task, mr, mr.parser(), &wg, results)
+	result := <-results
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	return result.RecordStats
+}
+
+func TestSkipMissingIntermediate(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR), writeInput(t, dir, "b.txt", "P004 Ann Lee 12 asthma inhaler\n"))
+	mapAll(t, mr)
+	if err := os.Remove(intermediateName(mr, "diagnosis", mr.Files[1], 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reducePartition(context.Background(), 0, mr); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("reducePartition = %v, want the missing file error", err)
+	}
+
+	mr.SkipMissingIntermediate = true
+	handler := &captureHandler{}
+	mr.Logger = slog.New(handler)
+	counts, err := reducePartition(context.Background(), 0, mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(counts["diagnosis"], want) {
+		t.Errorf("diagnosis = %v, want %v", counts["diagnosis"], want)
+	}
+	if counts["treatment"]["inhaler"] != 1 {
+		t.Errorf("treatment = %v, want the second file's treatment kept", counts["treatment"])
+	}
+	if !reflect.DeepEqual(handler.messages, []string{"missing intermediate file skipped"}) {
+		t.Errorf("logged %q, want one missing file warning", handler.messages)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.Checksums = true
+	mapAll(t, mr)
+	if _, err := reducePartition(context.Background(), 0, mr); err != nil {
+		t.Fatalf("reducePartition before corruption = %v", err)
+	}
+
+	name := intermediateName(mr, "diagnosis", mr.Files[0], 0, 0)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, append(data, "\"flu\" 100\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reducePartition(context.Background(), 0, mr); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("reducePartition = %v, want a checksum mismatch", err)
+	}
+}
+
+func TestDiscoverInputsRecursive(t *testing.T) {
+	dir := t.TempDir()
+	top := writeInput(t, dir, "top.txt", sampleEHR)
+	cardiology := writeInput(t, dir, "cardiology/a.txt", sampleEHR)
+	peds := writeInput(t, dir, "peds/2024/b.txt.gz", gzipped(t, sampleEHR))
+	writeInput(t, dir, "peds/2024/map-diagnosis-0-0.txt", "flu 2\n")
+
+	files, err := DiscoverInputs(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{cardiology, peds, top}; !reflect.DeepEqual(files, want) {
+		t.Errorf("recursive DiscoverInputs = %v, want %v", files, want)
+	}
+	if files, _ := DiscoverInputs(dir, false); !reflect.DeepEqual(files, []string{top}) {
+		t.Errorf("DiscoverInputs = %v, want only %s", files, top)
+	}
+}
+
+func TestCountBySource(t *testing.T) {
+	dir := t.TempDir()
+	small := writeInput(t, dir, "small.txt", "P004 Ann Lee 12 asthma inhaler\n")
+	large := writeInput(t, dir, "large.txt", sampleEHR+sampleEHR)
+	mr := newTestJob(t, small, large)
+	mr.NReduce = 2
+	mr.CountBySource = true
+	if got, want := runJob(t, mr).Sources, map[string]int{small: 1, large: 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sources = %v, want %v", got, want)
+	}
+}
+
+func TestMultiWordKeysRoundTrip(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt",
+		"P001 John Smith 45 \"chest pain\" \"bed rest\"\nP002 Jane Doe 30 \"chest pain\" fluids\nP003 Bob Jones 70 chest rest\n"))
+	mr.NReduce = 2
+	result := runJob(t, mr)
+	if want := map[string]int{"chest pain": 2, "chest": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if want := map[string]int{"bed rest": 1, "fluids": 1, "rest": 1}; !reflect.DeepEqual(result.Treatment, want) {
+		t.Errorf("Treatment = %v, want %v", result.Treatment, want)
+	}
+
+	for _, key := range []string{"chest pain", "a\tb", `say "hi"`, "1 2"} {
+		var line bytes.Buffer
+		writeCountLine(mr, &line, key, 7)
+		got, count, err := parseCountLine(strings.TrimSuffix(line.String(), "\n"), mr.fieldSep())
+		if err != nil || got != key || count != 7 {
+			t.Errorf("round trip of %q = %q, %d, %v", key, got, count, err)
+		}
+	}
+}
+
+func TestAgeStats(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt",
+		"P001 Amy Ray 10 flu rest\nP002 Ben Orr 20 flu rest\nP003 Cal Fox 60 flu rest\n"+
+			"P004 Dee Low 30 cold rest\nP005 Eve Kim 40 cold rest\nP006 Fay Moe 40 flu rest\nP007 Gus Lee abc cold rest\n"))
+	mr.NReduce = 2
+	mr.AgeStats = true
+	want := map[string]AgeSummary{
+		"flu":  {Count: 4, Mean: 32.5, Median: 30},
+		"cold": {Count: 2, Mean: 35, Median: 35},
+	}
+	if got := runJob(t, mr).AgeStats; !reflect.DeepEqual(got, want) {
+		t.Errorf("AgeStats = %+v, want %+v", got, want)
+	}
+}
+
+func TestBracketsFromBoundaries(t *testing.T) {
+	brackets, err := BracketsFromBoundaries([]int{18, 40, 65})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(brackets, DefaultAgeBrackets) {
+		t.Errorf("brackets = %+v, want the defaults", brackets)
+	}
+	for _, boundaries := range [][]int{nil, {40, 18}, {18, 18}, {-1, 10}, {0, 10}} {
+		if _, err := BracketsFromBoundaries(boundaries); err == nil {
+			t.Errorf("BracketsFromBoundaries(%v) succeeded", boundaries)
+		}
+	}
+
+	mr := &MapReduce{}
+	if mr.AgeBrackets, err = BracketsFromBoundaries([]int{13, 21}); err != nil {
+		t.Fatal(err)
+	}
+	for age, want := range map[string]string{"0": "0-12", "12": "0-12", "13": "13-20", "20": "13-20", "21": "21+", "150": "21+", "x": unknownAgeBracket} {
+		if got := mr.ageBracket(age); got != want {
+			t.Errorf("ageBracket(%s) = %s, want %s", age, got, want)
+		}
+	}
+}
+
+func TestWriteRejects(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+"P004 short\nP005 Tom Hall abc flu rest\n")
+	mr := newTestJob(t, input)
+	mr.WriteRejects = true
+	mr.ValidateAge = true
+	runJob(t, mr)
+	data, err := os.ReadFile(filepath.Join(mr.OutputDir, "rejects.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("rejects.txt has %d lines, want 2:\n%s", len(lines), data)
+	}
+	for i, want := range []struct{ location, reason, record string }{
+		{input + ":4:", "expected 6 fields", "P004 short"},
+		{input + ":5:", `invalid age "abc"`, "P005 Tom Hall abc flu rest"},
+	} {
+		reason, record, _ := strings.Cut(lines[i], "\t")
+		if !strings.HasPrefix(reason, want.location) || !strings.Contains(reason, want.reason) || record != want.record {
+			t.Errorf("reject %d = %q, want %s %s ... %q", i, lines[i], want.location, want.reason, want.record)
+		}
+	}
+}
+
+func TestMapPanicReturnsError(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.Filter = func(EHR) bool { panic("bad filter") }
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Run(context.Background(), mr)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		var taskErr *TaskError
+		if !errors.As(err, &taskErr) || taskErr.Phase != "map" || !strings.Contains(err.Error(), "panicked: bad filter") {
+			t.Errorf("Run = %v, want the map task's panic", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run hung after a map task panicked")
+	}
+}
+
+func TestIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR), writeInput(t, dir, "b.txt", "P004 Ann Lee 12 flu inhaler\n"))
+	mr.NReduce = 2
+	mapAll(t, mr)
+
+	diagnoses := make(map[string]int)
+	for partition := 0; partition < mr.NReduce; partition++ {
+		files, err := mr.Intermediates(partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2*len(mr.kinds()) {
+			t.Fatalf("partition %d has %d intermediate files, want %d", partition, len(files), 2*len(mr.kinds()))
+		}
+		for _, file := range files {
+			if file.Partition != partition {
+				t.Errorf("%s reported under partition %d", file.Name, partition)
+			}
+			for key, count := range file.Counts {
+				if p := ihash(key) % mr.NReduce; p != partition {
+					t.Errorf("key %q shuffled to partition %d, want %d", key, partition, p)
+				}
+				if file.Kind == "diagnosis" {
+					diagnoses[key] += count
+				}
+			}
+		}
+	}
+	if want := map[string]int{"flu": 3, "cold": 1}; !reflect.DeepEqual(diagnoses, want) {
+		t.Errorf("shuffled diagnoses = %v, want %v", diagnoses, want)
+	}
+	if _, err := mr.Intermediates(2); err == nil {
+		t.Error("Intermediates accepted an out of range partition")
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	long := "P004 Ann Lee 12 " + strings.Repeat("x", 100*1024) + " rest\n"
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+long)
+	if _, err := RunInMemory(context.Background(), newTestJob(t, input)); err == nil || !strings.Contains(err.Error(), "token too long") {
+		t.Fatalf("RunInMemory with the default buffer = %v, want token too long", err)
+	}
+
+	mr := newTestJob(t, input)
+	mr.MaxLineBytes = 1 << 20
+	result := runJob(t, mr)
+	if result.Records.Counted != 4 || result.Diagnosis[strings.Repeat("x", 100*1024)] != 1 {
+		t.Errorf("Records = %+v", result.Records)
+	}
+}
+
+func TestPipedInput(t *testing.T) {
+	// A pipe stands in for standard input, as main passes os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		io.WriteString(w, sampleEHR)
+		w.Close()
+	}()
+	mr := newTestJob(t)
+	mr.InputReaders = []io.Reader{r}
+	result := runJob(t, mr)
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+	if !reflect.DeepEqual(mr.Files, []string{"input-0"}) {
+		t.Errorf("Files = %v, want the single input-0 placeholder", mr.Files)
+	}
+}
@@ -0,0 +1,636 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startMaster serves a master for mr on a free port until the test ends
+func startMaster(t *testing.T, mr *MapReduce, opts ...MasterOption) *Master {
+	t.Helper()
+	m := NewMaster(mr, append([]MasterOption{WithAddr(":0")}, opts...)...)
+	if _, err := m.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Shutdown() })
+	return m
+}
+
+// returnsWithin reports whether f returns within d
+func returnsWithin(f func(), d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestWorkersClaimEachMapTaskOnce(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 6; i++ {
+		files = append(files, writeInput(t, dir, fmt.Sprintf("in-%d.txt", i), sampleEHR))
+	}
+	mr := newTestJob(t, files...)
+	m := startMaster(t, mr)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			errs <- RunWorker(context.Background(), m.Addr, workerID, mr)
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats MasterStats
+	m.Stats(0, &stats)
+	claimed := 0
+	for _, n := range stats.MapTasks {
+		claimed += n
+	}
+	if claimed != len(files) {
+		t.Errorf("%d map tasks claimed, want %d", claimed, len(files))
+	}
+	for _, file := range files {
+		if got := stats.Records[file].Counted; got != 3 {
+			t.Errorf("%s: %d records counted, want 3", file, got)
+		}
+	}
+}
+
+func TestWaitBlocksOnUnacknowledgedMapTask(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt", "b.txt"}, NMap: 2, NReduce: 1}
+	m := NewMaster(mr)
+	var task int
+	var ok bool
+	for i := 0; i < 2; i++ {
+		if err := m.AssignMapTask(TaskArgs{WorkerID: "w"}, &task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only one of the two claimed tasks is reported complete
+	m.CompleteMapTask(CompleteArgs{Task: task}, &ok)
+	var reply string
+	m.Done(0, &reply)
+	if returnsWithin(m.Wait, 100*time.Millisecond) {
+		t.Fatal("Wait returned with a map task unacknowledged")
+	}
+}
+
+func TestDoneTwice(t *testing.T) {
+	m := NewMaster(&MapReduce{NReduce: 1})
+	waited := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(waited)
+	}()
+	var reply string
+	for i := 0; i < 2; i++ {
+		if err := m.Done(0, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after Done")
+	}
+	// Wait keeps returning once Done has been called
+	if !returnsWithin(m.Wait, time.Second) {
+		t.Fatal("second Wait did not return")
+	}
+}
+
+func TestTimedOutMapTaskIsRequeued(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1}
+	m := NewMaster(mr, WithTaskTimeout(50*time.Millisecond))
+
+	var first int
+	if err := m.AssignMapTask(TaskArgs{WorkerID: "slow"}, &first); err != nil {
+		t.Fatal(err)
+	}
+	// The slow worker sleeps past the timeout without acknowledging
+	deadline := time.Now().Add(2 * time.Second)
+	var second int
+	for {
+		err := m.AssignMapTask(TaskArgs{WorkerID: "fast"}, &second)
+		if err == nil {
+			break
+		}
+		if err != errMapTasksPending || time.Now().After(deadline) {
+			t.Fatalf("AssignMapTask: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if second != first {
+		t.Fatalf("second worker claimed task %d, want %d", second, first)
+	}
+	var ok bool
+	if err := m.CompleteMapTask(CompleteArgs{Task: second}, &ok); err != nil || !ok {
+		t.Fatalf("CompleteMapTask = %v, %v", ok, err)
+	}
+	if !returnsWithin(m.WaitMaps, time.Second) {
+		t.Error("map phase not complete after the retried task finished")
+	}
+}
+
+func TestCancelledMasterAssignsNoTasks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1}
+	m := NewMasterContext(ctx, mr)
+	cancel()
+	var task int
+	if err := m.AssignMapTask(TaskArgs{}, &task); err != context.Canceled {
+		t.Errorf("AssignMapTask = %v, want context.Canceled", err)
+	}
+	if err := m.AssignReduceTask(TaskArgs{}, &task); err != context.Canceled {
+		t.Errorf("AssignReduceTask = %v, want context.Canceled", err)
+	}
+}
+
+func TestDeadWorkerTaskIsReassigned(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1, HeartbeatTimeout: 100 * time.Millisecond}
+	m := NewMaster(mr)
+	var task int
+	if err := m.AssignMapTask(TaskArgs{WorkerID: "w1"}, &task); err != nil {
+		t.Fatal(err)
+	}
+	// While w1 keeps heartbeating its task stays assigned to it
+	var ok bool
+	for i := 0; i < 10; i++ {
+		m.Heartbeat("w1", &ok)
+		var other int
+		if err := m.AssignMapTask(TaskArgs{WorkerID: "w2"}, &other); err != errMapTasksPending {
+			t.Fatalf("AssignMapTask while w1 is alive = %d, %v; want errMapTasksPending", other, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	var reassigned int
+	for {
+		err := m.AssignMapTask(TaskArgs{WorkerID: "w2"}, &reassigned)
+		if err == nil {
+			break
+		}
+		if err != errMapTasksPending || time.Now().After(deadline) {
+			t.Fatalf("AssignMapTask after w1 stopped = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reassigned != task {
+		t.Errorf("w2 was assigned task %d, want %d", reassigned, task)
+	}
+	m.CompleteMapTask(CompleteArgs{Task: reassigned}, &ok)
+}
+
+func TestStatsCountTasksPerWorker(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt", "b.txt", "c.txt"}, NMap: 3, NReduce: 2}
+	m := startMaster(t, mr)
+	client, err := dialMaster(context.Background(), m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var task int
+	var ok bool
+	for _, worker := range []string{"w1", "w2", "w1"} {
+		if err := client.Call("Master.AssignMapTask", TaskArgs{WorkerID: worker}, &task); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Call("Master.CompleteMapTask", CompleteArgs{Task: task}, &ok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, worker := range []string{"w2", "w1"} {
+		if err := client.Call("Master.AssignReduceTask", TaskArgs{WorkerID: worker}, &task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats MasterStats
+	if err := client.Call("Master.Stats", 0, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"w1": 2, "w2": 1}; !reflect.DeepEqual(stats.MapTasks, want) {
+		t.Errorf("MapTasks = %v, want %v", stats.MapTasks, want)
+	}
+	if want := map[string]int{"w1": 1, "w2": 1}; !reflect.DeepEqual(stats.ReduceTasks, want) {
+		t.Errorf("ReduceTasks = %v, want %v", stats.ReduceTasks, want)
+	}
+}
+
+func TestMastersOnFreePorts(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1}
+	first, second := startMaster(t, mr), startMaster(t, mr)
+	if first.Addr == second.Addr {
+		t.Fatalf("both masters listen on %s", first.Addr)
+	}
+	for _, m := range []*Master{first, second} {
+		client, err := dialMaster(context.Background(), m.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		err = client.Call("Master.Ping", 0, &reply)
+		client.Close()
+		if err != nil || reply != "ok" {
+			t.Errorf("Ping %s = %q, %v", m.Addr, reply, err)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	m := startMaster(t, &MapReduce{NReduce: 1})
+	client, err := rpc.Dial("tcp", m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := m.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Shutdown(); err != nil {
+		t.Errorf("second Shutdown = %v", err)
+	}
+	if c, err := rpc.Dial("tcp", m.Addr); err == nil {
+		c.Close()
+		t.Fatal("Dial succeeded after Shutdown")
+	}
+	var reply string
+	if err := client.Call("Master.Ping", 0, &reply); err == nil {
+		t.Error("open connection still served after Shutdown")
+	}
+}
+
+func TestMasterOptions(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1, TaskTimeout: time.Minute}
+	m := NewMaster(mr, WithAddr(":0"), WithTaskTimeout(time.Second))
+	if m.taskTimeout != time.Second {
+		t.Errorf("taskTimeout = %v, want the WithTaskTimeout value", m.taskTimeout)
+	}
+	if _, err := m.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+	if m.Addr == ":0" || strings.HasSuffix(m.Addr, ":0") {
+		t.Errorf("Addr = %q, want the chosen port", m.Addr)
+	}
+	if m := NewMaster(mr); m.taskTimeout != time.Minute || m.Addr != "" {
+		t.Errorf("defaults: taskTimeout %v, Addr %q", m.taskTimeout, m.Addr)
+	}
+}
+
+func TestDialRetriesUntilListening(t *testing.T) {
+	// Reserve a free port, then release it for the master to take later
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dialed := make(chan error, 1)
+	go func() {
+		client, err := dialMaster(context.Background(), addr)
+		if err == nil {
+			client.Close()
+		}
+		dialed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	startMaster(t, &MapReduce{NReduce: 1}, WithAddr(addr))
+	if err := <-dialed; err != nil {
+		t.Fatalf("dialMaster = %v, want it to retry until the master listens", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMasterContext(ctx, &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1}, WithAddr(":0"))
+	if _, err := m.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+	client, err := dialMaster(context.Background(), m.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply string
+	if err := client.Call("Master.Ping", 0, &reply); err != nil || reply != "ok" {
+		t.Fatalf("Ping = %q, %v; want ok", reply, err)
+	}
+	cancel()
+	if err := client.Call("Master.Ping", 0, &reply); err == nil {
+		t.Error("Ping succeeded after the master's context was cancelled")
+	}
+}
+
+func TestOrderedAssignment(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt", "b.txt", "c.txt", "d.txt"}, NMap: 4, NReduce: 1, Ordered: true}
+	m := NewMaster(mr)
+	var order []int
+	var ok bool
+	for worker := 0; ; worker = 1 - worker {
+		var task int
+		err := m.AssignMapTask(TaskArgs{WorkerID: fmt.Sprintf("w%d", worker)}, &task)
+		if err == errNoMoreMapTasks {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		// No other task is handed out while one is outstanding
+		var other int
+		if err := m.AssignMapTask(TaskArgs{WorkerID: "other"}, &other); err != errMapTasksPending {
+			t.Fatalf("second AssignMapTask = %d, %v; want errMapTasksPending", other, err)
+		}
+		order = append(order, task)
+		m.CompleteMapTask(CompleteArgs{Task: task}, &ok)
+	}
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(order, want) {
+		t.Errorf("tasks assigned in order %v, want %v", order, want)
+	}
+}
+
+// TestConcurrentRPCs is meant to be run with -race
+func TestConcurrentRPCs(t *testing.T) {
+	const goroutines = 20
+	var files []string
+	for i := 0; i < 200; i++ {
+		files = append(files, fmt.Sprintf("in-%d.txt", i))
+	}
+	mr := &MapReduce{Files: files, NMap: len(files), NReduce: 1, HeartbeatTimeout: time.Minute}
+	m := startMaster(t, mr, WithTaskTimeout(time.Minute))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			client, err := dialMaster(context.Background(), m.Addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+			for {
+				var ok bool
+				if err := client.Call("Master.Heartbeat", workerID, &ok); err != nil {
+					errs <- err
+					return
+				}
+				var stats MasterStats
+				if err := client.Call("Master.Stats", 0, &stats); err != nil {
+					errs <- err
+					return
+				}
+				var task int
+				err := client.Call("Master.AssignMapTask", TaskArgs{WorkerID: workerID}, &task)
+				if err != nil && err.Error() == errNoMoreMapTasks.Error() {
+					return
+				} else if err != nil && err.Error() == errMapTasksPending.Error() {
+					time.Sleep(time.Millisecond)
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				if err := client.Call("Master.CompleteMapTask", CompleteArgs{Task: task, Stats: RecordStats{Read: 1, Counted: 1}}, &ok); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("worker-%d", g))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var stats MasterStats
+	m.Stats(0, &stats)
+	claimed := 0
+	for _, n := range stats.MapTasks {
+		claimed += n
+	}
+	if claimed != len(files) || len(stats.Records) != len(files) {
+		t.Errorf("%d tasks claimed and %d completed, want %d", claimed, len(stats.Records), len(files))
+	}
+	if !returnsWithin(m.WaitMaps, time.Second) {
+		t.Error("map phase not complete")
+	}
+}
+
+func TestReduceWorkerWaitsForLateMap(t *testing.T) {
+	dir := t.TempDir()
+	mr := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR), writeInput(t, dir, "b.txt", "P004 Ann Lee 12 asthma inhaler\n"))
+	m := startMaster(t, mr)
+	var ok bool
+	m.CompleteMapTask(CompleteArgs{Task: 0, Stats: mapOne(t, mr, 0)}, &ok)
+
+	reduced := make(chan error, 1)
+	go func() {
+		reduced <- RunReduceWorker(context.Background(), m.Addr, "reducer", mr)
+	}()
+	// The second map's output is flushed after the reducer starts asking
+	time.Sleep(2 * workerPollInterval)
+	select {
+	case err := <-reduced:
+		t.Fatalf("reduce worker finished before the map phase: %v", err)
+	default:
+	}
+	m.CompleteMapTask(CompleteArgs{Task: 1, Stats: mapOne(t, mr, 1)}, &ok)
+	if err := <-reduced; err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := reduceOutputName(mr, 0, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "asthma 1") || !strings.Contains(string(data), "flu 2") {
+		t.Errorf("reduce output is missing a map task's counts:\n%s", data)
+	}
+}
+
+func TestReduceWorkerGivesUp(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1, ReduceRetries: 1, OutputDir: t.TempDir()}
+	m := startMaster(t, mr)
+	err := RunReduceWorker(context.Background(), m.Addr, "reducer", mr)
+	if err == nil || !strings.Contains(err.Error(), "after 1 retries") {
+		t.Errorf("RunReduceWorker = %v, want it to give up", err)
+	}
+}
+
+func TestReduceWorkerDefaultID(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	m := startMaster(t, mr)
+	if err := RunWorker(context.Background(), m.Addr, "", mr); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunReduceWorker(context.Background(), m.Addr, "", mr); err != nil {
+		t.Fatal(err)
+	}
+	var stats MasterStats
+	m.Stats(0, &stats)
+	if stats.ReduceTasks[""] != 0 || len(stats.ReduceTasks) != 1 {
+		t.Errorf("ReduceTasks = %v, want the task under a generated worker ID", stats.ReduceTasks)
+	}
+}
+
+// scrape reads the master's metrics endpoint into a map from metric name to
+// value
+func scrape(t *testing.T, m *Master) map[string]int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	metrics := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		var name string
+		var value int
+		if _, err := fmt.Sscanf(line, "%s %d", &name, &value); err != nil {
+			t.Fatalf("malformed metric line %q: %v", line, err)
+		}
+		metrics[name] = value
+	}
+	return metrics
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mr := &MapReduce{Files: []string{"a.txt", "b.txt"}, NMap: 2, NReduce: 1}
+	m := startMaster(t, mr)
+
+	before := scrape(t, m)
+	for _, name := range []string{
+		"mapreduce_map_tasks_assigned_total",
+		"mapreduce_map_tasks_completed_total",
+		"mapreduce_reduce_tasks_completed_total",
+		"mapreduce_parse_errors_total",
+	} {
+		if value, ok := before[name]; !ok || value != 0 {
+			t.Errorf("%s = %d, %v before any work, want 0", name, value, ok)
+		}
+	}
+
+	var task int
+	if err := m.AssignMapTask(TaskArgs{WorkerID: "w1"}, &task); err != nil {
+		t.Fatal(err)
+	}
+	var ok bool
+	m.CompleteMapTask(CompleteArgs{Task: task, Stats: RecordStats{Read: 5, Counted: 3, Skipped: 2}}, &ok)
+	after := scrape(t, m)
+	want := map[string]int{
+		"mapreduce_map_tasks_assigned_total":  1,
+		"mapreduce_map_tasks_completed_total": 1,
+		"mapreduce_records_read_total":        5,
+		"mapreduce_parse_errors_total":        2,
+	}
+	for name, value := range want {
+		if after[name] != value {
+			t.Errorf("%s = %d, want %d", name, after[name], value)
+		}
+	}
+}
+
+func TestResetRunsSecondJob(t *testing.T) {
+	dir := t.TempDir()
+	jobs := []*MapReduce{
+		newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR)),
+		newTestJob(t, writeInput(t, dir, "b.txt", "P004 Ann Lee 12 asthma inhaler\n"), writeInput(t, dir, "c.txt", "P005 Tom Hill 50 asthma rest\n")),
+	}
+	m := startMaster(t, jobs[0])
+	for i, mr := range jobs {
+		if i > 0 {
+			m.Reset(mr)
+		}
+		if err := RunWorker(context.Background(), m.Addr, "mapper", mr); err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		if err := RunReduceWorker(context.Background(), m.Addr, "reducer", mr); err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		var reply string
+		m.Done(0, &reply)
+		if !returnsWithin(m.Wait, time.Second) {
+			t.Fatalf("job %d: Wait did not return after Done", i)
+		}
+
+		var stats MasterStats
+		m.Stats(0, &stats)
+		if stats.MapTasks["mapper"] != mr.NMap || stats.ReduceTasks["reducer"] != 1 {
+			t.Errorf("job %d: Stats = %+v, want only this job's tasks", i, stats)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(jobs[1].OutputDir, "reduce-out-0.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "asthma 2") || strings.Contains(string(data), "flu") {
+		t.Errorf("second job's output mixes in the first job:\n%s", data)
+	}
+}
+
+func TestErrNoMoreTasks(t *testing.T) {
+	m := startMaster(t, &MapReduce{Files: []string{"a.txt"}, NMap: 1, NReduce: 1})
+	var task int
+	if err := m.AssignMapTask(TaskArgs{WorkerID: "w1"}, &task); err != nil {
+		t.Fatal(err)
+	}
+	err := m.AssignMapTask(TaskArgs{WorkerID: "w1"}, &task)
+	if !errors.Is(err, ErrNoMoreTasks) {
+		t.Errorf("AssignMapTask on a drained queue = %v, want ErrNoMoreTasks", err)
+	}
+	var ok bool
+	m.CompleteMapTask(CompleteArgs{Task: task}, &ok)
+	if err := m.AssignReduceTask(TaskArgs{WorkerID: "w1"}, &task); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AssignReduceTask(TaskArgs{WorkerID: "w1"}, &task); !errors.Is(err, ErrNoMoreTasks) {
+		t.Errorf("AssignReduceTask on a drained queue = %v, want ErrNoMoreTasks", err)
+	}
+	if errors.Is(errMapTasksPending, ErrNoMoreTasks) {
+		t.Error("errMapTasksPending matches ErrNoMoreTasks")
+	}
+}
@@ -0,0 +1,351 @@
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runOutput runs mr with Run and returns the contents of reduce partition 0
+// in format
+func runOutput(t *testing.T, mr *MapReduce, format string) string {
+	t.Helper()
+	if _, err := Run(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	name, err := reduceOutputName(mr, 0, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestJSONOutput(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.OutputFormat = "json"
+	var out ReduceOutput
+	if err := json.Unmarshal([]byte(runOutput(t, mr, "json")), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(out.Diagnosis, want) {
+		t.Errorf("diagnosis = %v, want %v", out.Diagnosis, want)
+	}
+	if want := map[string]int{"rest": 1, "fluids": 1, "antiviral": 1}; !reflect.DeepEqual(out.Treatment, want) {
+		t.Errorf("treatment = %v, want %v", out.Treatment, want)
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.csv",
+		"P001,John Smith,45,flu,rest\nP002,Jane Doe,30,cold,fluids\nP003,Ann Lee,12,\"flu, mild\",rest\n"))
+	mr.Parser = CSVParser{}
+	mr.OutputFormat = "csv"
+	rows, err := csv.NewReader(strings.NewReader(runOutput(t, mr, "csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"category", "key", "count"},
+		{"diagnosis", "cold", "1"},
+		{"diagnosis", "flu", "1"},
+		{"diagnosis", "flu, mild", "1"},
+		{"treatment", "fluids", "1"},
+		{"treatment", "rest", "2"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestMultipleOutputFormats(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.OutputFormats = []string{"text", "json"}
+	text := runOutput(t, mr, "text")
+	fromText := map[string]map[string]int{}
+	var section string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if kind, ok := strings.CutSuffix(line, " Counts:"); ok {
+			section = kind
+			fromText[section] = make(map[string]int)
+			continue
+		}
+		var key string
+		var count int
+		if _, err := fmt.Sscanf(line, "%s %d", &key, &count); err != nil {
+			t.Fatalf("malformed text output line %q", line)
+		}
+		fromText[section][key] = count
+	}
+
+	name, err := reduceOutputName(mr, 0, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out ReduceOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(out.Diagnosis, want) {
+		t.Errorf("JSON diagnosis = %v, want %v", out.Diagnosis, want)
+	}
+	if !reflect.DeepEqual(out.Diagnosis, fromText["Diagnosis"]) || !reflect.DeepEqual(out.Treatment, fromText["Treatment"]) {
+		t.Errorf("JSON %+v disagrees with text %v", out, fromText)
+	}
+}
+
+func TestSortedOutputGolden(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+"P004 Ann Lee 12 cold rest\nP005 Tom Hall 55 cold rest\n")
+	for _, sortBy := range []string{"key", "count"} {
+		golden, err := os.ReadFile(filepath.Join("testdata", "sort-"+sortBy+".golden"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for run := 0; run < 2; run++ {
+			mr := newTestJob(t, input)
+			mr.SortBy = sortBy
+			if got := runOutput(t, mr, "text"); got != string(golden) {
+				t.Errorf("SortBy %q run %d:\n%s\nwant:\n%s", sortBy, run, got, golden)
+			}
+		}
+	}
+}
+
+func TestTopN(t *testing.T) {
+	// Diagnosis dNN appears NN times, except d11 which is given an extra
+	// record so that it ties with d12
+	var records strings.Builder
+	for d := 1; d <= 12; d++ {
+		n := d
+		if d == 11 {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&records, "P%02d%02d Ann Lee 30 d%02d rest\n", d, i, d)
+		}
+	}
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", records.String()))
+	mr.TopN = 3
+	want := "Diagnosis Counts:\nd11 12\nd12 12\nd10 10\nTreatment Counts:\nrest 79\n"
+	if got := runOutput(t, mr, "text"); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR)
+	want := runOutput(t, newTestJob(t, input), "text")
+
+	mr := newTestJob(t, input)
+	mr.Compress = true
+	mr.KeepIntermediate = true
+	compressed := runOutput(t, mr, "text")
+	zr, err := gzip.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("decompressed output:\n%s\nwant:\n%s", got, want)
+	}
+	for _, name := range intermediateFiles(t, mr.OutputDir) {
+		if !strings.HasSuffix(name, ".txt.gz") {
+			t.Errorf("intermediate %s is not compressed", name)
+		}
+	}
+}
+
+func TestMergeOutput(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 asthma inhaler\nP005 Tom Hall 55 diabetes insulin\nP006 Sue Park 61 cold rest\n")
+	want := runOutput(t, newTestJob(t, input), "text")
+
+	mr := newTestJob(t, input)
+	mr.NReduce = 3
+	mr.MergeOutput = true
+	if _, err := Run(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	name, err := mergedOutputName(mr, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("merged output:\n%s\nwant:\n%s", got, want)
+	}
+	if partitions, _ := filepath.Glob(filepath.Join(mr.OutputDir, "reduce-out-*")); len(partitions) != 0 {
+		t.Errorf("partition files written alongside the merged output: %v", partitions)
+	}
+}
+
+func TestMergeOutputsAcrossRuns(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR))
+	runOutput(t, first, "text")
+	second := newTestJob(t, writeInput(t, dir, "b.txt", "P004 Ann Lee 12 flu inhaler\nP005 Tom Hall 55 asthma rest\n"))
+	second.OutputFormat = "json"
+	runOutput(t, second, "json")
+
+	var inputs []string
+	for _, run := range []struct {
+		mr     *MapReduce
+		format string
+	}{{first, "text"}, {second, "json"}} {
+		name, err := reduceOutputName(run.mr, 0, run.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, name)
+	}
+	out := filepath.Join(dir, "combined.json")
+	if err := MergeOutputs(inputs, out); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var combined ReduceOutput
+	if err := json.Unmarshal(data, &combined); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"flu": 3, "cold": 1, "asthma": 1}; !reflect.DeepEqual(combined.Diagnosis, want) {
+		t.Errorf("diagnosis = %v, want %v", combined.Diagnosis, want)
+	}
+	if want := map[string]int{"rest": 2, "fluids": 1, "antiviral": 1, "inhaler": 1}; !reflect.DeepEqual(combined.Treatment, want) {
+		t.Errorf("treatment = %v, want %v", combined.Treatment, want)
+	}
+
+	if err := MergeOutputs([]string{filepath.Join(dir, "missing.txt")}, out); err == nil {
+		t.Error("MergeOutputs succeeded without its input")
+	}
+}
+
+func TestRunIDKeepsEarlierOutputs(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	var outputs []string
+	for _, id := range []string{"20240101-120000", "20240101-120001"} {
+		mr.RunID = id
+		result, err := Run(context.Background(), mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, result.Outputs...)
+	}
+	if len(outputs) != 2 || outputs[0] == outputs[1] {
+		t.Fatalf("outputs = %v, want two distinct files", outputs)
+	}
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err != nil {
+			t.Error(err)
+		}
+	}
+	if want := filepath.Join(mr.OutputDir, "reduce-out-20240101-120000-0.txt"); outputs[0] != want {
+		t.Errorf("first output = %s, want %s", outputs[0], want)
+	}
+	id := NewRunID()
+	if _, err := time.Parse("20060102-150405", id); err != nil {
+		t.Errorf("NewRunID = %q, want a timestamp: %v", id, err)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	var buf bytes.Buffer
+	mr.OutputSink = WriterSink(&buf)
+	if _, err := Run(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	want := "Diagnosis Counts:\ncold 1\nflu 2\nTreatment Counts:\nantiviral 1\nfluids 1\nrest 1\n"
+	if buf.String() != want {
+		t.Errorf("sink received:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if outputs, _ := filepath.Glob(filepath.Join(mr.OutputDir, "reduce-out*")); len(outputs) != 0 {
+		t.Errorf("output files written despite OutputSink: %v", outputs)
+	}
+}
+
+// failingWriter is an output that rejects every write
+type failingWriter struct{}
+
+var errDiskFull = errors.New("disk full")
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errDiskFull }
+
+func (failingWriter) Close() error { return nil }
+
+func TestTextOutputWriteError(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR))
+	mr.GroupByAge = true
+	mr.CrossTab = true
+	mr.OutputSink = func(string) (io.WriteCloser, error) { return failingWriter{}, nil }
+	if _, err := Run(context.Background(), mr); !errors.Is(err, errDiskFull) {
+		t.Errorf("Run = %v, want the sink's write error", err)
+	}
+
+	counts := kindCounts{"agebracket": {"0-17|flu": 1}, "crosstab": {"flu|rest": 1}}
+	for name, write := range map[string]func() error{
+		"writeTextOutput": func() error { return writeTextOutput(failingWriter{}, mr, counts) },
+		"writeAgeCounts":  func() error { return writeAgeCounts(failingWriter{}, mr, counts["agebracket"]) },
+		"writeCrossTab":   func() error { return writeCrossTab(failingWriter{}, mr, counts["crosstab"]) },
+	} {
+		if err := write(); !errors.Is(err, errDiskFull) {
+			t.Errorf("%s = %v, want the write error", name, err)
+		}
+	}
+}
+
+func TestPipeFieldSep(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt",
+		"P001|John Smith|45|chest pain|bed rest\nP002|Jane Doe|30|flu|rest\nP003|Bob Jones|70|chest pain|rest\n"))
+	mr.FieldSep = "|"
+	mr.KeepIntermediate = true
+	want := "Diagnosis Counts:\nchest pain|2\nflu|1\nTreatment Counts:\nbed rest|1\nrest|2\n"
+	if got := runOutput(t, mr, "text"); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+	data, err := os.ReadFile(intermediateName(mr, "diagnosis", mr.Files[0], 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\"chest pain\"|2\n\"flu\"|1\n"; string(data) != want {
+		t.Errorf("intermediate = %q, want %q", data, want)
+	}
+}
+
+func TestMinCount(t *testing.T) {
+	mr := newTestJob(t, writeInput(t, t.TempDir(), "a.txt", sampleEHR+
+		"P004 Ann Lee 12 cold rest\nP005 Tom Hall 55 asthma rest\nP006 Sue Park 61 flu inhaler\n"))
+	mr.MinCount = 2
+	// flu 3, cold 2 and rest 3 meet the threshold; asthma and the single
+	// treatments fall below it
+	want := "Diagnosis Counts:\ncold 2\nflu 3\nTreatment Counts:\nrest 3\n"
+	if got := runOutput(t, mr, "text"); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,282 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEHR(t *testing.T) {
+	ehr, err := ParseEHR("P001 John Smith 45 flu rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EHR{PatientID: "P001", Name: "John Smith", Age: "45", Diagnosis: "flu", Treatment: "rest"}
+	if !reflect.DeepEqual(ehr, want) {
+		t.Errorf("ParseEHR = %+v, want %+v", ehr, want)
+	}
+}
+
+func TestParseEHRMalformed(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"P001 John Smith 45 flu",
+		"P001 John Smith 45 flu rest extra",
+		"P001 John Smith 45 flu rest extra more",
+	} {
+		_, err := ParseEHR(line)
+		if err == nil {
+			t.Errorf("ParseEHR(%q) succeeded", line)
+			continue
+		}
+		if !strings.Contains(err.Error(), "expected 6 fields") || !strings.Contains(err.Error(), `"`+line+`"`) {
+			t.Errorf("ParseEHR(%q) error %q does not describe the line", line, err)
+		}
+	}
+}
+
+func TestParseEHRNames(t *testing.T) {
+	for _, tc := range []struct {
+		line       string
+		nameTokens int
+		name       string
+	}{
+		{"P001 Cher 70 flu rest", 1, "Cher"},
+		{"P002 John Smith 45 flu rest", 2, "John Smith"},
+		{"P003 Maria de la Cruz 30 cold fluids", 4, "Maria de la Cruz"},
+	} {
+		ehr, err := ParseEHRNames(tc.line, tc.nameTokens)
+		if err != nil {
+			t.Errorf("ParseEHRNames(%q, %d): %v", tc.line, tc.nameTokens, err)
+			continue
+		}
+		if ehr.Name != tc.name || ehr.Diagnosis == "" || ehr.Treatment == "" {
+			t.Errorf("ParseEHRNames(%q, %d) = %+v, want name %q", tc.line, tc.nameTokens, ehr, tc.name)
+		}
+	}
+	if _, err := ParseEHRNames("P003 Maria de la Cruz 30 cold fluids", 2); err == nil {
+		t.Error("four-word name parsed with two name tokens")
+	}
+}
+
+func TestNameTokensOption(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", "P001 Maria de la Cruz 30 cold fluids\nP002 Ana Sofia de Leon 41 flu rest\n")
+	mr := newTestJob(t, input)
+	mr.NameTokens = 4
+	mr.GroupByFields = []string{"Name"}
+	result := runJob(t, mr)
+	want := map[string]int{"Maria de la Cruz": 1, "Ana Sofia de Leon": 1}
+	if !reflect.DeepEqual(result.Fields["Name"], want) {
+		t.Errorf("Name counts = %v, want %v", result.Fields["Name"], want)
+	}
+}
+
+func TestOptionalFields(t *testing.T) {
+	parser := TextParser{OptionalFields: []string{"Physician"}}
+	ehr, err := parser.Parse("P001 John Smith 45 flu rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.Treatment != "rest" || ehr.Extra != nil {
+		t.Errorf("six-field Parse = %+v, want no extra fields", ehr)
+	}
+	ehr, err = parser.Parse("P002 Jane Doe 30 cold fluids Dr.Patel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"Physician": "Dr.Patel"}; ehr.Treatment != "fluids" || !reflect.DeepEqual(ehr.Extra, want) {
+		t.Errorf("seven-field Parse = %+v, want Extra %v", ehr, want)
+	}
+	if _, err := parser.Parse("P003 Bob Jones 70 flu rest Dr.Patel ward-3"); err == nil {
+		t.Error("Parse accepted a field beyond the optional ones")
+	}
+
+	input := writeInput(t, t.TempDir(), "a.txt", "P001 John Smith 45 flu rest\nP002 Jane Doe 30 cold fluids Dr.Patel\n")
+	mr := newTestJob(t, input)
+	mr.OptionalFields = []string{"Physician"}
+	result := runJob(t, mr)
+	if result.Records.Counted != 2 || result.Records.Skipped != 0 {
+		t.Errorf("Records = %+v, want both records counted", result.Records)
+	}
+	if result.Treatment["fluids"] != 1 {
+		t.Errorf("Treatment = %v, want the physician kept out of it", result.Treatment)
+	}
+}
+
+func TestSchemaParser(t *testing.T) {
+	schema := []string{"PatientID", "Ward", "Age", "Diagnosis"}
+	record, err := ParseRecord("P001 ward-3 45 flu", schema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"PatientID": "P001", "Ward": "ward-3", "Age": "45", "Diagnosis": "flu"}; !reflect.DeepEqual(record, want) {
+		t.Errorf("ParseRecord = %v, want %v", record, want)
+	}
+	if _, err := ParseRecord("P001 ward-3 45", schema, ""); err == nil {
+		t.Error("ParseRecord accepted a three-field line")
+	}
+
+	input := writeInput(t, t.TempDir(), "a.txt", "P001|ward-3|45|flu\nP002|ward-3|30|cold\nP003|ward-1|70|flu\n")
+	mr := newTestJob(t, input)
+	mr.Schema = schema
+	mr.FieldSep = "|"
+	mr.GroupByFields = []string{"Ward", "Diagnosis"}
+	result := runJob(t, mr)
+	if want := map[string]int{"ward-3": 2, "ward-1": 1}; !reflect.DeepEqual(result.Fields["Ward"], want) {
+		t.Errorf("Ward counts = %v, want %v", result.Fields["Ward"], want)
+	}
+	if want := map[string]int{"flu": 2, "cold": 1}; !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+func TestGroupByOptionalField(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.txt", "P001 John Smith 45 flu rest Dr.Patel\nP002 Jane Doe 30 cold fluids\n")
+	mr := newTestJob(t, input)
+	mr.OptionalFields = []string{"Physician"}
+	mr.GroupByFields = []string{"Physician"}
+	if got, want := runJob(t, mr).Fields["Physician"], map[string]int{"Dr.Patel": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Physician counts = %v, want %v", got, want)
+	}
+}
+
+func TestCSVParser(t *testing.T) {
+	ehr, err := CSVParser{}.Parse(`P001,"Smith, John",45,flu,"rest, fluids"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EHR{PatientID: "P001", Name: "Smith, John", Age: "45", Diagnosis: "flu", Treatment: "rest, fluids"}
+	if !reflect.DeepEqual(ehr, want) {
+		t.Errorf("Parse = %+v, want %+v", ehr, want)
+	}
+	if _, err := (CSVParser{}).Parse("P001,John,45,flu"); err == nil {
+		t.Error("four-column line parsed")
+	}
+}
+
+func TestCSVInput(t *testing.T) {
+	input := writeInput(t, t.TempDir(), "a.csv", "P001,\"Smith, John\",45,flu,rest\nP002,\"Doe, Jane\",30,\"cold, mild\",fluids\nP003,Bob,70,flu,antiviral\n")
+	mr := newTestJob(t, input)
+	mr.Parser = CSVParser{}
+	result := runJob(t, mr)
+	want := map[string]int{"flu": 2, "cold, mild": 1}
+	if !reflect.DeepEqual(result.Diagnosis, want) {
+		t.Errorf("Diagnosis = %v, want %v", result.Diagnosis, want)
+	}
+}
+
+func TestJSONParser(t *testing.T) {
+	ehr, err := JSONParser{}.Parse(`{"patient_id":"P001","name":"John Smith","age":"45","diagnosis":"flu","treatment":"rest","ward":"3B"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.PatientID != "P001" || ehr.Diagnosis != "flu" || ehr.Treatment != "rest" {
+		t.Errorf("Parse = %+v", ehr)
+	}
+	if _, err := (JSONParser{}).Parse(`{"patient_id":`); err == nil || !strings.Contains(err.Error(), "invalid json record") {
+		t.Errorf("malformed JSON error = %v", err)
+	}
+}
+
+func TestJSONInputMatchesText(t *testing.T) {
+	dir := t.TempDir()
+	var lines strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(sampleEHR), "\n") {
+		ehr, err := ParseEHR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(ehr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines.Write(data)
+		lines.WriteByte('\n')
+	}
+	text := runJob(t, newTestJob(t, writeInput(t, dir, "a.txt", sampleEHR)))
+	mr := newTestJob(t, writeInput(t, dir, "a.json", lines.String()))
+	mr.Parser = JSONParser{}
+	fromJSON := runJob(t, mr)
+	if !reflect.DeepEqual(fromJSON.Diagnosis, text.Diagnosis) || !reflect.DeepEqual(fromJSON.Treatment, text.Treatment) {
+		t.Errorf("JSON counts %v %v, text counts %v %v", fromJSON.Diagnosis, fromJSON.Treatment, text.Diagnosis, text.Treatment)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		age  string
+		want int
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"45", 45, true},
+		{"150", 150, true},
+		{"151", 0, false},
+		{"abc", 0, false},
+		{"-5", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseAge(tc.age)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseAge(%q) = %d, %v; want %d, ok %v", tc.age, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestTSVParser(t *testing.T) {
+	parser, err := NewParser("tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ehr, err := parser.Parse("P001\tJohn Smith\t45\tchest pain\tbed rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.Name != "John Smith" || ehr.Diagnosis != "chest pain" || ehr.Treatment != "bed rest" {
+		t.Errorf("Parse = %+v", ehr)
+	}
+	if _, err := parser.Parse("P001 John Smith 45 flu rest"); err == nil {
+		t.Error("Parse accepted a space-separated line")
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		tokens []string
+		quoted []bool
+	}{
+		{"a  b\tc", []string{"a", "b", "c"}, []bool{false, false, false}},
+		{`"chest pain" rest`, []string{"chest pain", "rest"}, []bool{true, false}},
+		{`a "say \"hi\"" b`, []string{"a", `say "hi"`, "b"}, []bool{false, true, false}},
+		{`a "" b`, []string{"a", "", "b"}, []bool{false, true, false}},
+	} {
+		tokens, quoted, err := tokenize(tc.line)
+		if err != nil || !reflect.DeepEqual(tokens, tc.tokens) || !reflect.DeepEqual(quoted, tc.quoted) {
+			t.Errorf("tokenize(%q) = %q, %v, %v; want %q, %v", tc.line, tokens, quoted, err, tc.tokens, tc.quoted)
+		}
+	}
+	for _, line := range []string{`a "open`, `a "closed"b`} {
+		if _, _, err := tokenize(line); err == nil {
+			t.Errorf("tokenize(%q) succeeded", line)
+		}
+	}
+}
+
+func TestParseEHRQuotedFields(t *testing.T) {
+	ehr, err := ParseEHR(`P001 "Mary Ann" Smith 45 "chest pain" "bed rest"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.Name != "Mary Ann Smith" || ehr.Diagnosis != "chest pain" || ehr.Treatment != "bed rest" {
+		t.Errorf("ParseEHR = %+v", ehr)
+	}
+	ehr, err = ParseEHR(`P002 Jane Doe 30 "chest pain" rest`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ehr.Diagnosis != "chest pain" || ehr.Treatment != "rest" {
+		t.Errorf("ParseEHR mixed quoting = %+v", ehr)
+	}
+}